@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/logic"
+	"github.com/abatalev/smartdockerbuild/internal/osrunner"
+)
+
+// Affected returns Dockerfiles matched by Options.Dockerfiles (the whole tree by
+// default) whose inputs, config file or upstream images changed between the git ref
+// Options.Since and the working tree. Reasons are printed to Out.
+func (b Builder) Affected(ctx context.Context, workDir string) ([]string, error) {
+	patterns := b.Options.Dockerfiles
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	dockerFiles, err := logic.FindDockerFiles(workDir, patterns)
+	if err != nil {
+		return nil, err
+	}
+	for _, dockerFile := range dockerFiles {
+		if !logic.IsDockerFile(dockerFile) {
+			return nil, errors.New("unknown Dockerfile name " + dockerFile)
+		}
+	}
+	images, err := logic.SortImages(describeImages(workDir, dockerFiles))
+	if err != nil {
+		return nil, err
+	}
+	changed, err := b.changedFiles(ctx, workDir, b.Options.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	isAffected := make(map[string]bool)
+	affected := make([]string, 0)
+	for _, image := range images {
+		reason, err := changedInput(workDir, image.DockerFile, changed)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range image.Upstream {
+			if reason == "" && isAffected[name] {
+				reason = "upstream image " + name + " changed"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		fmt.Fprintln(b.out(), " -> "+image.DockerFile+":", reason)
+		isAffected[image.Name] = true
+		affected = append(affected, image.DockerFile)
+	}
+	return affected, nil
+}
+
+// RunAffected prints affected Dockerfiles to stdout (into the summary with -output json)
+// or builds them with -build.
+// Unaffected upstream images of the run are only hashed, not built.
+func (b Builder) RunAffected(ctx context.Context, workDir string) Summary {
+	affected, err := b.Affected(ctx, workDir)
+	if err != nil {
+		fmt.Fprintln(b.out(), " -> ", err)
+		return Summary{Images: make([]Report, 0), Error: err.Error(), ExitCode: exitCode(err)}
+	}
+	if !b.Options.isBuild {
+		if b.Options.Output == "json" {
+			return Summary{Images: make([]Report, 0), Affected: affected}
+		}
+		for _, dockerFile := range affected {
+			fmt.Println(dockerFile)
+		}
+		return Summary{Images: make([]Report, 0)}
+	}
+	if len(affected) == 0 {
+		fmt.Fprintln(b.out(), " -> nothing to build")
+		return Summary{Images: make([]Report, 0)}
+	}
+	b.selected = make(map[string]bool)
+	for _, dockerFile := range affected {
+		b.selected[dockerFile] = true
+	}
+	if len(b.Options.Dockerfiles) == 0 {
+		b.Options.Dockerfiles = []string{"."}
+	}
+	return b.BuildAll(ctx, workDir)
+}
+
+// changedFiles returns files (relative to workDir) changed, added or removed since
+// the ref, untracked files are included.
+func (b Builder) changedFiles(ctx context.Context, workDir, ref string) ([]string, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("git ref is not set, use -since <ref>")
+	}
+	commands := [][]string{
+		{"git", "diff", "--name-only", "--no-renames", "--relative", ref, "--"},
+		{"git", "ls-files", "--others", "--exclude-standard"},
+	}
+	files := make([]string, 0)
+	for _, args := range commands {
+		pipeline := osrunner.NewPipeline(args...)
+		pipeline.Dir = workDir
+		res, err := runCommandPipeline(ctx, b.Runner, b.Options.Timeout, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range strings.Split(string(res.Stdout), "\n") {
+			if file = strings.TrimSpace(file); file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+func changedInput(workDir, dockerFile string, changed []string) (string, error) {
+	patterns, err := logic.GetPatternsForDockerFile(workDir, dockerFile)
+	if err != nil {
+		return "", err
+	}
+	configName := ""
+	exclude := []string{}
+	if logic.IsDockerFile(dockerFile) {
+		imageName := logic.GetImageName(filepath.Join(workDir, dockerFile))
+		configName = filepath.ToSlash(filepath.Join(filepath.Dir(dockerFile), imageName+".sdb.yaml"))
+		if cfg, err := imageConfig(workDir, dockerFile); err == nil {
+			patterns = append(patterns, cfg.HashInputs.Files...)
+			exclude = cfg.HashExclude
+		}
+	}
+	for _, file := range changed {
+		if file == configName {
+			return "config " + file + " changed", nil
+		}
+		if hash.MatchPatterns(file, patterns) && (file == dockerFile || !hash.MatchPatterns(file, exclude)) {
+			return file + " changed", nil
+		}
+	}
+	return "", nil
+}
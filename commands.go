@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abatalev/smartdockerbuild/internal/cache"
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/logic"
+)
+
+var commands = []struct {
+	Name  string
+	Usage string
+}{
+	{Name: "build", Usage: "Build images when needed, gather facts, create tags (default)"},
+	{Name: "hash", Usage: "Print hash tags of Dockerfiles"},
+	{Name: "facts", Usage: "Gather facts of built images"},
+	{Name: "tags", Usage: "Gather facts and create tags of built images"},
+	{Name: "push", Usage: "Gather facts, create and push tags of built images"},
+	{Name: "plan", Usage: "Show build, tag and push operations without executing them"},
+	{Name: "inspect", Usage: "Show inputs, hash tag, image state and cached facts"},
+	{Name: "diff", Usage: "Show changed inputs between two hash tags: sdb diff <[image:]hash> <[image:]hash>"},
+	{Name: "clean", Usage: "Remove cached facts and manifests of images (all images without arguments)"},
+	{Name: "affected", Usage: "List or build images changed since a git ref"},
+}
+
+func isCommand(name string) bool {
+	for _, command := range commands {
+		if command.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isBuildCommand tells whether the command may build images.
+func isBuildCommand(command string) bool {
+	return command == "" || command == "build" || command == "plan" || command == "affected"
+}
+
+func printCommands(out io.Writer) {
+	fmt.Fprintln(out, "Usage: sdb [command] [flags] <Dockerfile|directory|pattern>...")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", command.Name, command.Usage)
+	}
+}
+
+type imageHash struct {
+	Image    logic.Image
+	HashTag  string
+	Manifest hash.Manifest
+}
+
+// HashTags returns hash tags of images of Options.Dockerfiles in build order.
+func (b Builder) HashTags(workDir string) ([]imageHash, error) {
+	if len(b.Options.Dockerfiles) == 0 {
+		return nil, errors.New("no Dockerfile")
+	}
+	dockerFiles, err := logic.FindDockerFiles(workDir, b.Options.Dockerfiles)
+	if err != nil {
+		return nil, err
+	}
+	images, err := logic.SortImages(describeImages(workDir, dockerFiles))
+	if err != nil {
+		return nil, err
+	}
+	hashTags := make(map[string]string)
+	hashes := make([]imageHash, 0, len(images))
+	for _, image := range images {
+		fullDockerFile := filepath.Join(workDir, image.DockerFile)
+		if _, err := os.Stat(fullDockerFile); err != nil {
+			return nil, err
+		}
+		if !logic.IsDockerFile(fullDockerFile) {
+			return nil, fmt.Errorf("unknown Dockerfile name %s", image.DockerFile)
+		}
+		upstream := make(map[string]string)
+		for _, name := range image.Upstream {
+			upstream[name] = hashTags[name]
+		}
+		cfg, err := imageConfig(workDir, image.DockerFile)
+		if err != nil {
+			return nil, err
+		}
+		hashTag, manifest, err := cfg.hashInputs(workDir, image.DockerFile, image.Name, upstream)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveManifest(image.Name, hashTag, manifest); err != nil {
+			fmt.Fprintln(b.out(), " ---> warning!", err)
+		}
+		hashTags[image.Name] = hashTag
+		hashes = append(hashes, imageHash{Image: image, HashTag: hashTag, Manifest: manifest})
+	}
+	return hashes, nil
+}
+
+// PrintHashTags prints the hash tag of a single Dockerfile, "Dockerfile image:tag"
+// lines for many of them. With -explain every hash tag is followed by its manifest,
+// with -diff by changes since the manifest of a file or of an image label.
+func (b Builder) PrintHashTags(ctx context.Context, out io.Writer, workDir string) int {
+	hashes, err := b.HashTags(workDir)
+	if err == nil && b.Options.DiffWith != "" && len(hashes) != 1 {
+		err = errors.New("-diff needs a single Dockerfile")
+	}
+	if err != nil {
+		fmt.Fprintln(b.out(), " -> ", err)
+		return 1
+	}
+	if len(hashes) == 1 && !b.Options.isExplain && b.Options.DiffWith == "" {
+		fmt.Fprintln(out, hashes[0].HashTag)
+		return 0
+	}
+	for _, h := range hashes {
+		fmt.Fprintln(out, h.Image.DockerFile, h.Image.Name+":"+h.HashTag)
+		if b.Options.isExplain {
+			for _, entry := range h.Manifest.Public() {
+				fmt.Fprintln(out, "  "+entry.Kind, entry.Name, entry.Digest)
+			}
+		}
+		if b.Options.DiffWith == "" {
+			continue
+		}
+		old, err := b.loadManifest(ctx, workDir, b.Options.DiffWith)
+		if err != nil {
+			fmt.Fprintln(b.out(), " -> ", err)
+			return 1
+		}
+		changes := hash.Diff(old.Public(), h.Manifest.Public())
+		if len(changes) == 0 {
+			fmt.Fprintln(out, "  no changes since", b.Options.DiffWith)
+		}
+		for _, change := range changes {
+			fmt.Fprintln(out, "  "+change.String())
+		}
+	}
+	return 0
+}
+
+// loadManifest reads the manifest from a file or finds the manifest of the label of an image
+// in the cache. Labels of images built by older sdb versions keep the manifest itself.
+func (b Builder) loadManifest(ctx context.Context, workDir, source string) (hash.Manifest, error) {
+	if data, err := os.ReadFile(filepath.Join(workDir, source)); err == nil {
+		return hash.ParseManifest(string(data))
+	}
+	text, err := b.manifestLabel(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not a manifest file or an image: %w", source, err)
+	}
+	if text == "" {
+		return nil, fmt.Errorf("%s: image has no %s label", source, hash.ManifestLabel)
+	}
+	if !strings.HasPrefix(text, "sha256:") {
+		return hash.ParseManifest(text)
+	}
+	manifest, err := cache.FindManifestByDigest(text)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: manifest %s of the %s label is not in the local cache", source, text,
+			hash.ManifestLabel)
+	}
+	return manifest, err
+}
+
+// manifestLabel returns the manifest label of the image, "" if there is none.
+func (b Builder) manifestLabel(ctx context.Context, image string) (string, error) {
+	res, err := runCommand(ctx, b.Runner, b.Options.Timeout, []string{"docker", "image", "inspect",
+		"--format", "{{ index .Config.Labels \"" + hash.ManifestLabel + "\" }}", image})
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(string(res.Stdout), "\n")
+	if strings.TrimSpace(text) == "" || text == "<no value>" {
+		return "", nil
+	}
+	return text, nil
+}
+
+// DiffManifests prints inputs added, removed and modified between two hash tags
+// given as Options.Dockerfiles. A hash tag is looked up in saved manifests of all
+// images, "image:tag" in saved manifests of the image, then in its label.
+func (b Builder) DiffManifests(ctx context.Context, out io.Writer, workDir string) int {
+	if len(b.Options.Dockerfiles) != 2 {
+		fmt.Fprintln(b.out(), " -> usage: sdb diff <[image:]hash> <[image:]hash>")
+		return 1
+	}
+	manifests := make([]hash.Manifest, 0, 2)
+	for _, ref := range b.Options.Dockerfiles {
+		manifest, err := b.findManifest(ctx, workDir, ref)
+		if err != nil {
+			fmt.Fprintln(b.out(), " -> ", err)
+			return 1
+		}
+		manifests = append(manifests, manifest)
+	}
+	added, removed, modified := 0, 0, 0
+	for _, change := range hash.Diff(manifests[0].Public(), manifests[1].Public()) {
+		fmt.Fprintln(out, change.String())
+		switch {
+		case change.Old == "":
+			added++
+		case change.New == "":
+			removed++
+		default:
+			modified++
+		}
+	}
+	fmt.Fprintln(b.out(), " -> added:", added, "removed:", removed, "modified:", modified)
+	return 0
+}
+
+func (b Builder) findManifest(ctx context.Context, workDir, ref string) (hash.Manifest, error) {
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		manifest, err := cache.LoadManifest(ref[:idx], ref[idx+1:])
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return manifest, err
+		}
+		return b.loadManifest(ctx, workDir, ref)
+	}
+	names, err := cache.FindManifests(ref)
+	if err != nil {
+		return nil, err
+	}
+	switch len(names) {
+	case 0:
+		return nil, fmt.Errorf("no saved manifest of %s", ref)
+	case 1:
+		return cache.LoadManifest(names[0], ref)
+	}
+	return nil, fmt.Errorf("hash %s is known for images %s, use image:hash", ref, strings.Join(names, ", "))
+}
+
+// Clean removes cached facts and manifests of images of Options.Dockerfiles or the whole cache.
+func (b Builder) Clean(workDir string) int {
+	if len(b.Options.Dockerfiles) == 0 {
+		dir, err := cache.Dir()
+		if err == nil {
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			fmt.Fprintln(b.out(), " -> ", err)
+			return 1
+		}
+		fmt.Fprintln(b.out(), " -> removed", dir)
+		return 0
+	}
+	dockerFiles, err := logic.FindDockerFiles(workDir, b.Options.Dockerfiles)
+	if err != nil {
+		fmt.Fprintln(b.out(), " -> ", err)
+		return 1
+	}
+	for _, dockerFile := range dockerFiles {
+		if !logic.IsDockerFile(dockerFile) {
+			fmt.Fprintln(b.out(), " -> unknown Dockerfile name", dockerFile)
+			return 1
+		}
+	}
+	for _, image := range describeImages(workDir, dockerFiles) {
+		if err := cache.Clean(image.Name); err != nil {
+			fmt.Fprintln(b.out(), " -> ", err)
+			return 1
+		}
+		fmt.Fprintln(b.out(), " -> cleaned", image.Name)
+	}
+	return 0
+}
+
+// inspect shows what sdb knows about the image without changing anything.
+func inspect(r reporter, hashName, hashTag string, isExists bool) int {
+	state := "image not built"
+	if isExists {
+		state = "image exists"
+	}
+	r.Println(" --> hash", hashName+":"+hashTag, "("+state+")")
+	for _, input := range r.report.Inputs {
+		r.Println(" ---> input:", input.Path, input.Digest)
+	}
+	factValues, err := cache.LoadFacts(hashName, hashTag)
+	if err != nil {
+		r.Println(" ---> no cached facts")
+		return 0
+	}
+	r.report.Facts = factValues
+	for _, name := range sortedKeys(factValues) {
+		r.Println(" ---> cached fact:", name, "=", factValues[name])
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+)
+
+// Dir is the root of sdb state kept between runs ($XDG_CACHE_HOME/sdb).
+func Dir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sdb"), nil
+}
+
+// HashesFile keeps digests of input files, see hash.FileCache.
+func HashesFile() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hashes.json"), nil
+}
+
+// ImageDir is the directory of an image, names with slashes are escaped.
+func ImageDir(kind, imageName string) (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, kind, url.PathEscape(imageName)), nil
+}
+
+func SaveFacts(imageName, hashTag string, facts map[string]string) error {
+	dir, err := ImageDir("facts", imageName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hashTag+".json"), data, 0600)
+}
+
+// LoadFacts returns facts gathered from the image before, os.ErrNotExist if there are none.
+func LoadFacts(imageName, hashTag string) (map[string]string, error) {
+	dir, err := ImageDir("facts", imageName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, hashTag+".json"))
+	if err != nil {
+		return nil, err
+	}
+	facts := make(map[string]string)
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, err
+	}
+	return facts, nil
+}
+
+// SaveManifest keeps the public manifest of the image hash tag for "sdb diff" and
+// its Digest for FindManifestByDigest.
+func SaveManifest(imageName, hashTag string, manifest hash.Manifest) error {
+	dir, err := ImageDir("manifests", imageName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, hashTag+".digest"), []byte(manifest.Digest()), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hashTag+".manifest"), []byte(manifest.Public().String()), 0600)
+}
+
+// LoadManifest returns the manifest saved by SaveManifest, os.ErrNotExist if there is none.
+func LoadManifest(imageName, hashTag string) (hash.Manifest, error) {
+	dir, err := ImageDir("manifests", imageName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, hashTag+".manifest"))
+	if err != nil {
+		return nil, err
+	}
+	return hash.ParseManifest(string(data))
+}
+
+// FindManifests returns names of images with a saved manifest of the hash tag.
+func FindManifests(hashTag string) ([]string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "manifests", "*", hashTag+".manifest"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		name, err := url.PathUnescape(filepath.Base(filepath.Dir(match)))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// FindManifestByDigest returns a saved manifest with the digest, os.ErrNotExist if there is none.
+func FindManifestByDigest(digest string) (hash.Manifest, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "manifests", "*", "*.digest"))
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			return nil, err
+		}
+		if string(data) != digest {
+			continue
+		}
+		data, err = os.ReadFile(strings.TrimSuffix(match, ".digest") + ".manifest")
+		if err != nil {
+			return nil, err
+		}
+		return hash.ParseManifest(string(data))
+	}
+	return nil, fmt.Errorf("manifest %s: %w", digest, os.ErrNotExist)
+}
+
+// Clean removes everything kept for the image.
+func Clean(imageName string) error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	kinds, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, kind := range kinds {
+		if !kind.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, kind.Name(), url.PathEscape(imageName))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageDir(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", "/cache")
+	dir, err := ImageDir("facts", "abatalev/example")
+	assertions.NoError(err)
+	assertions.Equal("/cache/sdb/facts/abatalev%2Fexample", dir)
+}
+
+func TestSaveAndLoadFacts(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	_, err := LoadFacts("a/b", "1")
+	assertions.True(errors.Is(err, os.ErrNotExist))
+	assertions.NoError(SaveFacts("a/b", "1", map[string]string{"os-name": "alpine"}))
+	facts, err := LoadFacts("a/b", "1")
+	assertions.NoError(err)
+	assertions.Equal(map[string]string{"os-name": "alpine"}, facts)
+
+	dir, _ := ImageDir("facts", "a/b")
+	assertions.NoError(os.WriteFile(filepath.Join(dir, "2.json"), []byte("x"), 0600))
+	_, err = LoadFacts("a/b", "2")
+	assertions.Error(err)
+}
+
+func TestClean(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	assertions.NoError(Clean("a/b"))
+	hashesFile, err := HashesFile()
+	assertions.NoError(err)
+	assertions.NoError(os.MkdirAll(filepath.Dir(hashesFile), 0750))
+	assertions.NoError(os.WriteFile(hashesFile, []byte("{}"), 0600))
+	assertions.NoError(SaveFacts("a/b", "1", map[string]string{}))
+	assertions.NoError(SaveFacts("c", "1", map[string]string{}))
+	assertions.NoError(Clean("a/b"))
+	_, err = LoadFacts("a/b", "1")
+	assertions.True(errors.Is(err, os.ErrNotExist))
+	_, err = LoadFacts("c", "1")
+	assertions.NoError(err)
+}
+
+func TestManifests(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	_, err := LoadManifest("a/b", "1")
+	assertions.True(errors.Is(err, os.ErrNotExist))
+	manifest := hash.Manifest{{Kind: "file", Name: "Dockerfile", Digest: "2"}, {Kind: "from", Name: "c", Digest: "3"}}
+	assertions.NoError(SaveManifest("a/b", "1", manifest))
+	assertions.NoError(SaveManifest("c", "1", manifest))
+	assertions.NoError(SaveManifest("c", "2", manifest))
+	loaded, err := LoadManifest("a/b", "1")
+	assertions.NoError(err)
+	assertions.Equal(manifest, loaded)
+
+	names, err := FindManifests("1")
+	assertions.NoError(err)
+	assertions.ElementsMatch([]string{"a/b", "c"}, names)
+	names, err = FindManifests("3")
+	assertions.NoError(err)
+	assertions.Empty(names)
+
+	found, err := FindManifestByDigest(manifest.Digest())
+	assertions.NoError(err)
+	assertions.Equal(manifest, found)
+	_, err = FindManifestByDigest("sha256:0")
+	assertions.True(errors.Is(err, os.ErrNotExist))
+
+	secret := append(manifest, hash.Entry{Kind: "env", Name: "PIN", Digest: hash.DigestValue("1234")})
+	assertions.NoError(SaveManifest("d", "1", secret))
+	found, err = FindManifestByDigest(secret.Digest())
+	assertions.NoError(err)
+	assertions.Equal("set", found[2].Digest)
+	data, err := os.ReadFile(filepath.Join(os.Getenv("XDG_CACHE_HOME"), "sdb", "manifests", "d", "1.manifest"))
+	assertions.NoError(err)
+	assertions.NotContains(string(data), hash.DigestValue("1234"))
+}
@@ -1,7 +1,8 @@
 package docker
 
 import (
-	"fmt"
+	"bufio"
+	"encoding/json"
 	"io"
 	"strings"
 )
@@ -12,60 +13,158 @@ type ProjectDependency struct { // from common
 }
 
 // TODO from bnd
-func ParseDockerFile(reader io.ReadCloser, dir string) ([]string, []ProjectDependency) {
+func ParseDockerFile(reader io.ReadCloser, dir string) ([]string, []ProjectDependency, error) {
 	// TODO support dockerignore (https://docs.docker.com/build/building/context/#dockerignore-files)
 	// TODO https://pkg.go.dev/github.com/moby/buildkit/frontend/dockerfile/parser
 	// TODO variables in COPY
 	list := make([]string, 0)
 	dependencies := make([]ProjectDependency, 0)
 	defer reader.Close()
-	buf := make([]byte, 32*1024)
-	for {
-		n, err := reader.Read(buf)
-		if err == io.EOF {
-			break
+	instructions, err := readInstructions(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, instruction := range instructions {
+		dependencies = parseFrom(instruction.Text, dependencies)
+		list = parseCopy(instruction.Text, list)
+	}
+	return list, dependencies, nil
+}
+
+// Source is a source of COPY or ADD in the build context, Pattern is its glob.
+type Source struct {
+	Line        int
+	Instruction string
+	Path        string
+	Pattern     string
+}
+
+// ParseSources returns sources of COPY and ADD instructions in the build context,
+// sources of other stages or images (--from), URLs and heredocs are skipped.
+func ParseSources(reader io.Reader) ([]Source, error) {
+	instructions, err := readInstructions(reader)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, 0)
+	for _, instruction := range instructions {
+		name, paths := copySources(instruction.Text)
+		for _, path := range paths {
+			sources = append(sources, Source{Line: instruction.Line, Instruction: name, Path: path,
+				Pattern: sourcePattern(path)})
+		}
+	}
+	return sources, nil
+}
+
+type instruction struct {
+	Line int
+	Text string
+}
+
+// readInstructions joins continuation lines, Line is the first line of an instruction.
+// Empty lines and comments are skipped.
+func readInstructions(reader io.Reader) ([]instruction, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	instructions := make([]instruction, 0)
+	var text strings.Builder
+	start := 0
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		if err != nil {
-			fmt.Println("ERROR", err)
-			break
+		if text.Len() == 0 {
+			start = n
 		}
-		if n > 0 {
-			ss := string(buf[:n]) // TODO work with buffer tail
-			for _, s := range strings.Split(ss, "\n") {
-				dependencies = parseFrom(s, dependencies)
-				list = parseCopy(s, list)
-			}
+		if strings.HasSuffix(line, "\\") {
+			text.WriteString(strings.TrimSuffix(line, "\\") + " ")
+			continue
 		}
+		text.WriteString(line)
+		instructions = append(instructions, instruction{Line: start, Text: text.String()})
+		text.Reset()
+	}
+	if text.Len() > 0 {
+		instructions = append(instructions, instruction{Line: start, Text: text.String()})
 	}
-	return list, dependencies
+	return instructions, scanner.Err()
 }
 
+// parseFrom returns the image of FROM and the name of the stage ("docker-stage") if any.
 func parseFrom(s string, list []ProjectDependency) []ProjectDependency {
 	ss := strings.ToLower(s)
 	if !strings.HasPrefix(ss, "from ") {
 		return list
 	}
-	sss := strings.Split(s, " ")
-	image := sss[1]
-	return append(list, ProjectDependency{Type: "docker-image", Value: image})
+	sss := strings.Fields(s)
+	for len(sss) > 2 && strings.HasPrefix(sss[1], "--") {
+		sss = append(sss[:1], sss[2:]...)
+	}
+	if len(sss) < 2 {
+		return list
+	}
+	list = append(list, ProjectDependency{Type: "docker-image", Value: sss[1]})
+	if len(sss) > 3 && strings.EqualFold(sss[2], "as") {
+		list = append(list, ProjectDependency{Type: "docker-stage", Value: sss[3]})
+	}
+	return list
 }
 
 func parseCopy(s string, list []string) []string {
-	ss := strings.ToLower(s)
-	if !(strings.HasPrefix(ss, "copy ") &&
-		!strings.Contains(ss, "--from=")) {
-		return list
+	_, paths := copySources(s)
+	for _, path := range paths {
+		list = append(list, sourcePattern(path))
 	}
+	return list
+}
 
-	sss := strings.Split(s, " ")
-	path := sss[1]
-	if path == "./" {
-		path = "**/*"
+// copySources returns the instruction (COPY or ADD) and its sources in the build context.
+// Sources with ARG or ENV variables are skipped, their values are known to docker build only.
+func copySources(s string) (string, []string) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return "", nil
+	}
+	name := strings.ToUpper(fields[0])
+	if name != "COPY" && name != "ADD" {
+		return "", nil
+	}
+	args := fields[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if strings.HasPrefix(strings.ToLower(args[0]), "--from=") {
+			return "", nil
+		}
+		args = args[1:]
 	}
+	if rest := strings.Join(args, " "); strings.HasPrefix(rest, "[") {
+		args = nil
+		if err := json.Unmarshal([]byte(rest), &args); err != nil {
+			return "", nil
+		}
+	}
+	if len(args) < 2 {
+		return "", nil
+	}
+	paths := make([]string, 0, len(args)-1)
+	for _, path := range args[:len(args)-1] {
+		if strings.HasPrefix(path, "<<") || strings.Contains(path, "://") || strings.HasPrefix(path, "git@") ||
+			strings.Contains(path, "$") {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return name, paths
+}
 
+func sourcePattern(path string) string {
+	if path == "." || path == "./" {
+		return "**/*"
+	}
 	path = strings.TrimPrefix(path, "./")
 	if strings.HasSuffix(path, "/") {
 		path += "**/*"
 	}
-	return append(list, path)
+	return path
 }
@@ -1,6 +1,8 @@
 package docker
 
 import (
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,6 +12,10 @@ func TestParseFrom(t *testing.T) {
 	assertions := require.New(t)
 	assertions.Len(parseFrom("from a", []ProjectDependency{}), 1)
 	assertions.Empty(parseFrom("copy a b", []ProjectDependency{}))
+	assertions.Equal([]ProjectDependency{
+		{Type: "docker-image", Value: "a:1"},
+		{Type: "docker-stage", Value: "build"},
+	}, parseFrom("FROM --platform=linux/amd64 a:1 AS build", []ProjectDependency{}))
 }
 
 func TestParseCopy(t *testing.T) {
@@ -38,6 +44,29 @@ func TestParseCopy(t *testing.T) {
 			result:   "/opt/**/*",
 			argument: "copy /opt/ /opt",
 		},
+		{
+			exists:   true,
+			result:   "**/*",
+			argument: "COPY . /app",
+		},
+		{
+			exists:   true,
+			result:   "app.sh",
+			argument: "ADD --chown=app:app --chmod=755 app.sh /opt/",
+		},
+		{
+			exists:   true,
+			result:   "a b",
+			argument: "COPY [\"a b\", \"/opt/\"]",
+		},
+		{
+			exists:   false,
+			argument: "ADD https://example.com/a.tgz /opt/",
+		},
+		{
+			exists:   false,
+			argument: "COPY ${DIR}/ /app/",
+		},
 	}
 
 	assertions := require.New(t)
@@ -51,3 +80,35 @@ func TestParseCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSources(t *testing.T) {
+	assertions := require.New(t)
+	sources, err := ParseSources(strings.NewReader("# syntax=docker/dockerfile:1\n" +
+		"FROM alpine AS build\n" +
+		"\n" +
+		"COPY go.mod \\\n" +
+		"     go.sum /src/\n" +
+		"  add ./cmd/ /src/cmd/\n" +
+		"COPY --from=build /bin/app /bin/\n" +
+		"COPY <<EOF /etc/app.conf\n"))
+	assertions.NoError(err)
+	assertions.Equal([]Source{
+		{Line: 4, Instruction: "COPY", Path: "go.mod", Pattern: "go.mod"},
+		{Line: 4, Instruction: "COPY", Path: "go.sum", Pattern: "go.sum"},
+		{Line: 6, Instruction: "ADD", Path: "./cmd/", Pattern: "cmd/**/*"},
+	}, sources)
+
+	_, err = ParseSources(strings.NewReader("FROM alpine\nCOPY " + strings.Repeat("a", 2*1024*1024) + " /\n"))
+	assertions.Error(err)
+}
+
+func TestParseDockerFile(t *testing.T) {
+	assertions := require.New(t)
+	files, dependencies, err := ParseDockerFile(io.NopCloser(strings.NewReader("FROM alpine\nCOPY a /\n")), ".")
+	assertions.NoError(err)
+	assertions.Equal([]string{"a"}, files)
+	assertions.Equal([]ProjectDependency{{Type: "docker-image", Value: "alpine"}}, dependencies)
+
+	_, _, err = ParseDockerFile(io.NopCloser(strings.NewReader(strings.Repeat("a", 2*1024*1024))), ".")
+	assertions.Error(err)
+}
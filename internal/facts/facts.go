@@ -0,0 +1,228 @@
+package facts
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed catalog/*.yaml
+var catalog embed.FS
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type Fact struct {
+	Name   string   `yaml:"name"`
+	Args   []string `yaml:"args"`
+	Source string   `yaml:"-"`
+}
+
+type Override struct {
+	Fact     Fact
+	Previous Fact
+}
+
+type Registry struct {
+	facts     map[string]Fact
+	Overrides []Override
+}
+
+type library struct {
+	Facts []Fact `yaml:"facts"`
+}
+
+var (
+	embeddedOnce sync.Once
+	embedded     []Fact
+	embeddedErr  error
+)
+
+func New() *Registry {
+	return &Registry{facts: make(map[string]Fact)}
+}
+
+// Load returns the embedded catalogue overridden by fact libraries from dirs,
+// dirs are given in order of increasing precedence.
+func Load(dirs []string) (*Registry, error) {
+	registry := New()
+	catalogFacts, err := embeddedFacts()
+	if err != nil {
+		return nil, err
+	}
+	registry.add(catalogFacts)
+	for _, dir := range dirs {
+		for _, fileName := range libraryFiles(dir) {
+			data, err := os.ReadFile(fileName)
+			if err != nil {
+				return nil, err
+			}
+			if err := registry.Add(data, fileName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return registry, nil
+}
+
+// Dirs returns fact library directories in order of increasing precedence:
+// user config, project and then extraDirs.
+func Dirs(workDir string, extraDirs []string) []string {
+	dirs := make([]string, 0)
+	if configDir := userConfigDir(); configDir != "" {
+		dirs = append(dirs, filepath.Join(configDir, "sdb", "facts"))
+	}
+	dirs = append(dirs, filepath.Join(workDir, ".sdb", "facts"))
+	return append(dirs, extraDirs...)
+}
+
+// CheckDirs returns an error when a directory given explicitly (-facts-dir) doesn't exist,
+// missing user and project directories are fine.
+func CheckDirs(dirs []string) error {
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config")
+}
+
+func embeddedFacts() ([]Fact, error) {
+	embeddedOnce.Do(func() {
+		embedded, embeddedErr = loadCatalog()
+	})
+	return embedded, embeddedErr
+}
+
+func loadCatalog() ([]Fact, error) {
+	entries, err := catalog.ReadDir("catalog")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Fact, 0)
+	for _, entry := range entries {
+		data, err := catalog.ReadFile(path.Join("catalog", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		facts, err := Parse(data, "embedded:"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, facts...)
+	}
+	return list, nil
+}
+
+func libraryFiles(dir string) []string {
+	files := make([]string, 0)
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Parse decodes and validates a fact library.
+func Parse(data []byte, source string) ([]Fact, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	lib := library{}
+	if err := decoder.Decode(&lib); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	names := make(map[string]bool)
+	for i := range lib.Facts {
+		lib.Facts[i].Source = source
+		if err := Validate(lib.Facts[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		if names[lib.Facts[i].Name] {
+			return nil, fmt.Errorf("%s: fact %q defined twice", source, lib.Facts[i].Name)
+		}
+		names[lib.Facts[i].Name] = true
+	}
+	return lib.Facts, nil
+}
+
+func Validate(fact Fact) error {
+	if !namePattern.MatchString(fact.Name) {
+		return fmt.Errorf("invalid fact name %q", fact.Name)
+	}
+	if len(fact.Args) == 0 {
+		return fmt.Errorf("fact %q: empty args", fact.Name)
+	}
+	isStageEmpty := true
+	for _, arg := range fact.Args {
+		if arg == "|" || arg == "|&" {
+			if isStageEmpty {
+				return fmt.Errorf("fact %q: empty pipeline stage", fact.Name)
+			}
+			isStageEmpty = true
+			continue
+		}
+		isStageEmpty = false
+	}
+	if isStageEmpty {
+		return fmt.Errorf("fact %q: empty pipeline stage", fact.Name)
+	}
+	return nil
+}
+
+// Add parses the library and registers its facts over the existing ones.
+func (r *Registry) Add(data []byte, source string) error {
+	facts, err := Parse(data, source)
+	if err != nil {
+		return err
+	}
+	r.add(facts)
+	return nil
+}
+
+func (r *Registry) add(facts []Fact) {
+	for _, fact := range facts {
+		if prev, ok := r.facts[fact.Name]; ok {
+			r.Overrides = append(r.Overrides, Override{Fact: fact, Previous: prev})
+		}
+		r.facts[fact.Name] = fact
+	}
+}
+
+func (r *Registry) Lookup(name string) (Fact, bool) {
+	fact, ok := r.facts[name]
+	return fact, ok
+}
+
+func (r *Registry) List() []Fact {
+	list := make([]Fact, 0, len(r.facts))
+	for _, fact := range r.facts {
+		list = append(list, fact)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,198 @@
+package facts
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(dirName string, files map[string]string) error {
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dirName, name), []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLoad(t *testing.T) {
+	assertions := require.New(t)
+	registry, err := Load([]string{})
+	assertions.NoError(err)
+	assertions.Len(registry.List(), 17)
+	assertions.Empty(registry.Overrides)
+}
+
+func TestLoadFromDirs(t *testing.T) {
+	assertions := require.New(t)
+	userDir := t.TempDir()
+	projectDir := t.TempDir()
+	assertions.NoError(writeFiles(userDir, map[string]string{
+		"node.yaml": "facts:\n  - name: node-version\n    args: [\"node --version\"]\n",
+		"os.yml":    "facts:\n  - name: os-name\n    args: [\"cat /etc/hostname\"]\n",
+		"readme.md": "facts:\n  - name: readme\n    args: [\"true\"]\n",
+	}))
+	assertions.NoError(writeFiles(projectDir, map[string]string{
+		"node.yaml": "facts:\n  - name: node-version\n    args: [\"node -v\"]\n",
+	}))
+
+	registry, err := Load([]string{userDir, projectDir, filepath.Join(projectDir, "absent")})
+	assertions.NoError(err)
+	assertions.Len(registry.List(), 17)
+	fact, ok := registry.Lookup("node-version")
+	assertions.True(ok)
+	assertions.Equal(Fact{Name: "node-version", Args: []string{"node -v"}, Source: filepath.Join(projectDir, "node.yaml")}, fact)
+	fact, _ = registry.Lookup("os-name")
+	assertions.Equal(filepath.Join(userDir, "os.yml"), fact.Source)
+	fact, _ = registry.Lookup("os-version")
+	assertions.Equal("embedded:alpine.yaml", fact.Source)
+	_, ok = registry.Lookup("readme")
+	assertions.False(ok)
+	assertions.Len(registry.Overrides, 3)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	assertions := require.New(t)
+	dir := t.TempDir()
+	assertions.NoError(writeFiles(dir, map[string]string{"bad.yaml": "facts:\n  - name: x\n"}))
+	_, err := Load([]string{dir})
+	assertions.Error(err)
+}
+
+func TestParse(t *testing.T) {
+	variants := []struct {
+		content string
+		isError bool
+	}{
+		{content: "", isError: false},
+		{content: "facts:\n  - name: a\n    args: [\"a\", \"|\", \"b\"]\n", isError: false},
+		{content: "facts:\n  - name: a\n    cmd: b\n    args: [\"a\"]\n", isError: true},
+		{content: "facts:\n  - name: \"\"\n    args: [\"a\"]\n", isError: true},
+		{content: "facts:\n  - name: a b\n    args: [\"a\"]\n", isError: true},
+		{content: "facts:\n  - name: a\n    args: [\"a\", \"|\"]\n", isError: true},
+		{content: "facts:\n  - name: a\n    args: [\"|&\", \"a\"]\n", isError: true},
+		{content: "facts:\n  - name: a\n    args: [\"a\", \"|\", \"|\", \"b\"]\n", isError: true},
+		{content: "facts:\n  - name: a\n    args: [\"a\"]\n  - name: a\n    args: [\"b\"]\n", isError: true},
+		{content: "hello", isError: true},
+	}
+	assertions := require.New(t)
+	for n, variant := range variants {
+		_, err := Parse([]byte(variant.content), "test")
+		assertions.Equal(variant.isError, err != nil, n)
+	}
+}
+
+// extractFact runs all stages of a fact except the first one (which is executed
+// inside the image) on the host, feeding them with the recorded output.
+func extractFact(args []string, recorded string) (string, error) {
+	stages := make([][]string, 0)
+	stage := make([]string, 0)
+	for _, arg := range args {
+		if arg == "|" || arg == "|&" {
+			stages = append(stages, stage)
+			stage = make([]string, 0)
+			continue
+		}
+		stage = append(stage, arg)
+	}
+	stages = append(stages, stage)
+
+	value := recorded
+	for _, stage := range stages[1:] {
+		cmd := exec.Command(stage[0], stage[1:]...)
+		cmd.Stdin = strings.NewReader(value)
+		out, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		value = string(out)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+func TestFactsCatalogue(t *testing.T) {
+	osRelease := map[string]string{
+		"alpine": "NAME=\"Alpine Linux\"\nID=alpine\nVERSION_ID=3.21.0\nPRETTY_NAME=\"Alpine Linux v3.21\"\n",
+		"debian": "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nNAME=\"Debian GNU/Linux\"\n" +
+			"VERSION_ID=\"12\"\nVERSION=\"12 (bookworm)\"\nVERSION_CODENAME=bookworm\nID=debian\n",
+		"ubuntu": "PRETTY_NAME=\"Ubuntu 24.04 LTS\"\nNAME=\"Ubuntu\"\nVERSION_ID=\"24.04\"\n" +
+			"VERSION_CODENAME=noble\nID=ubuntu\nID_LIKE=debian\n",
+		"rhel": "NAME=\"Red Hat Enterprise Linux\"\nVERSION=\"9.3 (Plow)\"\nID=\"rhel\"\n" +
+			"ID_LIKE=\"fedora\"\nVERSION_ID=\"9.3\"\nPRETTY_NAME=\"Red Hat Enterprise Linux 9.3 (Plow)\"\n",
+	}
+	variants := []struct {
+		fact     string
+		recorded string
+		result   string
+	}{
+		{fact: "os-name", recorded: osRelease["alpine"], result: "alpine"},
+		{fact: "os-version", recorded: osRelease["alpine"], result: "3.21.0"},
+		{fact: "os-name", recorded: osRelease["debian"], result: "debian"},
+		{fact: "os-version", recorded: osRelease["debian"], result: "12"},
+		{fact: "os-codename", recorded: osRelease["debian"], result: "bookworm"},
+		{fact: "os-name", recorded: osRelease["ubuntu"], result: "ubuntu"},
+		{fact: "os-version", recorded: osRelease["ubuntu"], result: "24.04"},
+		{fact: "os-codename", recorded: osRelease["ubuntu"], result: "noble"},
+		{fact: "os-name", recorded: osRelease["rhel"], result: "rhel"},
+		{fact: "os-version", recorded: osRelease["rhel"], result: "9.3"},
+		{fact: "os-pretty-name", recorded: osRelease["debian"], result: "Debian GNU/Linux 12 (bookworm)"},
+		{fact: "alpine-version", recorded: "3.21.0\n", result: "3.21.0"},
+		{fact: "debian-version", recorded: "12.5\n", result: "12.5"},
+		{fact: "rhel-version", recorded: "Red Hat Enterprise Linux release 9.3 (Plow)\n", result: "9.3"},
+		{fact: "node-version", recorded: "v20.11.1\n", result: "20.11.1"},
+		{fact: "python-version", recorded: "Python 3.12.2\n", result: "3.12.2"},
+		{fact: "go-version", recorded: "go version go1.22.1 linux/amd64\n", result: "1.22.1"},
+		{
+			fact: "dotnet-version",
+			recorded: "Microsoft.AspNetCore.App 8.0.2 [/usr/share/dotnet/shared/Microsoft.AspNetCore.App]\n" +
+				"Microsoft.NETCore.App 8.0.2 [/usr/share/dotnet/shared/Microsoft.NETCore.App]\n",
+			result: "8.0.2",
+		},
+		{fact: "ruby-version", recorded: "ruby 3.3.0 (2023-12-25 revision 5124f9ac75) [x86_64-linux]\n", result: "3.3.0"},
+		{fact: "ruby-version", recorded: "ruby 2.7.8p225 (2023-03-30 revision 1f4d455848) [x86_64-linux]\n", result: "2.7.8"},
+		{
+			fact: "php-version",
+			recorded: "PHP 8.3.3 (cli) (built: Feb 16 2024 21:41:12) (NTS)\n" +
+				"Copyright (c) The PHP Group\nZend Engine v4.3.3, Copyright (c) Zend Technologies\n",
+			result: "8.3.3",
+		},
+		{fact: "nginx-version", recorded: "nginx version: nginx/1.25.4\n", result: "1.25.4"},
+		{fact: "psql-version", recorded: "psql (PostgreSQL) 16.2 (Debian 16.2-1.pgdg120+2)\n", result: "16.2"},
+		{fact: "openssl-version", recorded: "OpenSSL 3.1.4 24 Oct 2023 (Library: OpenSSL 3.1.4 24 Oct 2023)\n", result: "3.1.4"},
+		{fact: "openssl-version", recorded: "LibreSSL 3.3.6\n", result: "3.3.6"},
+		{
+			fact: "java-version",
+			recorded: "openjdk version \"17.0.2\" 2022-01-18\n" +
+				"OpenJDK Runtime Environment (build 17.0.2+8-86)\n" +
+				"OpenJDK 64-Bit Server VM (build 17.0.2+8-86, mixed mode, sharing)\n",
+			result: "17.0.2-8-86",
+		},
+	}
+	assertions := require.New(t)
+	registry, err := Load([]string{})
+	assertions.NoError(err)
+	for n, variant := range variants {
+		fact, ok := registry.Lookup(variant.fact)
+		assertions.True(ok, variant.fact)
+		value, err := extractFact(fact.Args, variant.recorded)
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, value, n)
+	}
+}
+
+func TestFactsDirs(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CONFIG_HOME", "/xdg")
+	assertions.Equal([]string{"/xdg/sdb/facts", "w/.sdb/facts", "a", "b"}, Dirs("w", []string{"a", "b"}))
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "a.yaml")
+	assertions.NoError(os.WriteFile(fileName, []byte("facts: []\n"), 0644))
+	assertions.NoError(CheckDirs([]string{dir}))
+	assertions.Error(CheckDirs([]string{dir, filepath.Join(dir, "missing")}))
+	assertions.ErrorContains(CheckDirs([]string{fileName}), "is not a directory")
+}
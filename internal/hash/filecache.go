@@ -0,0 +1,154 @@
+package hash
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HashCache is used by CalcHashes when it is set.
+var HashCache *FileCache
+
+const (
+	// racyWindow: a file modified that recently may change again without changing
+	// its modification time, its digest is not cached.
+	racyWindow = 2 * time.Second
+	// staleAge: entries not used that long are dropped on Save.
+	staleAge = 30 * 24 * time.Hour
+	seenStep = 24 * time.Hour
+)
+
+// FileCache keeps digests of files between runs. An entry is used while the
+// path, size, modification time and inode of the file are the same.
+type FileCache struct {
+	mu        sync.Mutex
+	entries   map[string]fileCacheEntry
+	isChanged bool
+}
+
+type fileCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode,omitempty"`
+	Digest  string `json:"digest"`
+	Seen    int64  `json:"seen"`
+}
+
+func NewFileCache() *FileCache {
+	return &FileCache{entries: make(map[string]fileCacheEntry)}
+}
+
+// LoadFileCache reads the cache saved by Save, a missing file is an empty cache.
+func LoadFileCache(path string) (*FileCache, error) {
+	c := NewFileCache()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cache if it changed, entries not used for staleAge are dropped.
+func (c *FileCache) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isChanged {
+		return nil
+	}
+	stale := time.Now().Add(-staleAge).Unix()
+	for key, entry := range c.entries {
+		if entry.Seen < stale {
+			delete(c.entries, key)
+		}
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	c.isChanged = false
+	return nil
+}
+
+// digest returns the cached digest of the file or hashes it. Files with a
+// suspicious modification time (recent, in the future or unset) are always hashed.
+func (c *FileCache) digest(path string) (string, error) {
+	if c == nil {
+		return calcHashFile(path)
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	entry := fileCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Inode: inode(info)}
+	isRacy := info.ModTime().Unix() <= 0 || time.Since(info.ModTime()) < racyWindow
+
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	if ok && !isRacy && cached.Size == entry.Size && cached.ModTime == entry.ModTime && cached.Inode == entry.Inode {
+		if now.Sub(time.Unix(cached.Seen, 0)) > seenStep {
+			cached.Seen = now.Unix()
+			c.entries[key] = cached
+			c.isChanged = true
+		}
+		c.mu.Unlock()
+		return cached.Digest, nil
+	}
+	c.mu.Unlock()
+
+	digest, err := calcHashReader(f, path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isRacy {
+		if ok {
+			delete(c.entries, key)
+			c.isChanged = true
+		}
+		return digest, nil
+	}
+	entry.Digest = digest
+	entry.Seen = now.Unix()
+	c.entries[key] = entry
+	c.isChanged = true
+	return digest, nil
+}
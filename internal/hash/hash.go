@@ -1,68 +1,203 @@
 package hash
 
 import (
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"io/fs"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/bmatcuk/doublestar"
 )
 
-func WalkDirWithPatterns(workDir string, patters []string) []string {
-	if _, err := os.Lstat(workDir); err != nil {
-		return []string{}
+// WalkDirWithPatterns returns slash separated paths of files, directories and
+// symlinks of workDir (the build context) matching patterns. Symlinks are never
+// followed, a pattern outside of the context is an error as in docker build.
+func WalkDirWithPatterns(workDir string, patterns []string) ([]string, error) {
+	files, _, err := walkDir(workDir, patterns)
+	return files, err
+}
+
+// UnmatchedPatterns returns patterns matching nothing in workDir.
+func UnmatchedPatterns(workDir string, patterns []string) ([]string, error) {
+	_, matched, err := walkDir(workDir, patterns)
+	if err != nil {
+		return nil, err
+	}
+	unmatched := make([]string, 0)
+	for i, pattern := range patterns {
+		if !matched[i] {
+			unmatched = append(unmatched, pattern)
+		}
 	}
+	return unmatched, nil
+}
 
-	if !strings.HasSuffix(workDir, "/") {
-		workDir += "/"
+func walkDir(workDir string, patterns []string) ([]string, []bool, error) {
+	cleaned := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		p := path.Clean(strings.TrimPrefix(filepath.ToSlash(pattern), "/"))
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return nil, nil, fmt.Errorf("%s: outside of the build context %s", pattern, workDir)
+		}
+		cleaned = append(cleaned, p)
 	}
 	files := make([]string, 0)
-	err := filepath.Walk(workDir, func(path string, info fs.FileInfo, err error) error {
-		// log.Println("@@@@", path, workDir)
-		filename := strings.TrimPrefix(path, workDir)
-		if info.IsDir() {
+	matched := make([]bool, len(patterns))
+	// a matched directory is sent by docker with all its content, the walk is in
+	// lexical order, so the content follows the directory
+	matchedDir := ""
+	err := fs.WalkDir(os.DirFS(workDir), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if matchedDir != "" && strings.HasPrefix(name, matchedDir+"/") {
+			files = append(files, name)
 			return nil
 		}
-		if walkFunc(filename, patters) {
-			files = append(files, filename)
+		matchedDir = ""
+		isMatched := false
+		for i, p := range cleaned {
+			if ok, _ := doublestar.Match(p, name); ok {
+				matched[i] = true
+				isMatched = true
+			}
+		}
+		if isMatched {
+			files = append(files, name)
+			if d.IsDir() {
+				matchedDir = name
+			}
 		}
 		return nil
 	})
 	if err != nil {
-		// panic("!!!") // TODO remove panic
-		log.Println("ERROR", err)
-		return []string{}
+		return nil, nil, err
 	}
-	return files
+	return files, matched, nil
 }
 
-func walkFunc(filename string, patters []string) bool {
-	for _, p := range patters {
-		if x, _ := doublestar.Match(p, filename); x {
-			return true
+// MatchPatterns tells whether the slash separated filename or one of its directories
+// matches one of patterns.
+func MatchPatterns(filename string, patters []string) bool {
+	for name := filename; name != "." && name != "/"; name = path.Dir(name) {
+		for _, p := range patters {
+			if x, _ := doublestar.Match(p, name); x {
+				return true
+			}
 		}
 	}
 	return false
 }
 
-func CalcHashFiles(files []string) string {
-	s := ""
-	for _, file := range files {
-		s += file + "\n"
+// Workers limits the number of files hashed at the same time.
+var Workers = runtime.NumCPU()
+
+// CalcHashes returns "file digest" lines in the order of files. Files are read by
+// Workers goroutines (unchanged files are taken from HashCache), the error of the
+// first unreadable file is returned.
+func CalcHashes(workDir string, files []string) ([]string, error) {
+	digests := make([]string, len(files))
+	errs := make([]error, len(files))
+	workers := Workers
+	if workers > len(files) {
+		workers = len(files)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				digests[i], errs[i] = HashCache.digest(filepath.Join(workDir, files[i]))
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
 	}
-	return calcHashBytes([]byte(s))
+	close(indexes)
+	wg.Wait()
+
+	filesWithHashes := make([]string, 0, len(files))
+	for i, f := range files {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		filesWithHashes = appendFileAndHash(filesWithHashes, f, digests[i])
+	}
+	return filesWithHashes, nil
 }
 
-func CalcHashes(workDir string, files []string) []string {
-	filesWithHashes := make([]string, 0)
-	for _, f := range files {
-		filesWithHashes = appendFileAndHash(filesWithHashes, f, calcHashFile(filepath.Join(workDir, f)))
+// ExecMode is the mode of executable files in the manifest: like git, only the
+// executable bit is kept, other bits depend on the umask of the checkout.
+const ExecMode = "0755"
+
+var valueEscaper = strings.NewReplacer("%", "%25", " ", "%20", "\n", "%0A")
+
+// DigestValue is the digest of a value which must not be shown.
+func DigestValue(value string) string {
+	return calcHashBytes([]byte(value))
+}
+
+// EscapeValue makes a value usable as the digest of an entry.
+func EscapeValue(value string) string {
+	return valueEscaper.Replace(value)
+}
+
+// CalcManifest returns the manifest of files (relative to workDir) as Docker sends
+// them: "file" entries with digests of regular files followed by "mode" entries of
+// executable ones, "symlink" entries with link targets and "dir" entries.
+func CalcManifest(workDir string, files []string) (Manifest, error) {
+	infos := make([]fs.FileInfo, len(files))
+	regular := make([]string, 0, len(files))
+	for i, file := range files {
+		info, err := os.Lstat(filepath.Join(workDir, file))
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+		if info.Mode().IsRegular() {
+			regular = append(regular, file)
+		}
+	}
+	fileHashes, err := CalcHashes(workDir, regular)
+	if err != nil {
+		return nil, err
 	}
-	return filesWithHashes
+	fileEntries := FilesManifest(fileHashes)
+
+	m := make(Manifest, 0, len(files))
+	for i, file := range files {
+		mode := infos[i].Mode()
+		switch {
+		case mode.IsRegular():
+			m = append(m, fileEntries[0])
+			fileEntries = fileEntries[1:]
+			if mode.Perm()&0111 != 0 {
+				m = append(m, Entry{Kind: "mode", Name: file, Digest: ExecMode})
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(filepath.Join(workDir, file))
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, Entry{Kind: "symlink", Name: file, Digest: EscapeValue(filepath.ToSlash(target))})
+		case mode.IsDir():
+			m = append(m, Entry{Kind: "dir", Name: file, Digest: "-"})
+		}
+	}
+	return m, nil
 }
 
 func appendFileAndHash(filesWithHashes []string, f, hash string) []string {
@@ -70,14 +205,24 @@ func appendFileAndHash(filesWithHashes []string, f, hash string) []string {
 }
 
 func calcHashBytes(buf []byte) string {
-	// TODO bnd (hash.go)
-	h := sha1.New()
+	h := sha256.New()
 	h.Write(buf)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func calcHashFile(path string) string {
-	// TODO bnd (hash.go)
-	buf, _ := os.ReadFile(path)
-	return calcHashBytes(buf)
+func calcHashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return calcHashReader(f, path)
+}
+
+func calcHashReader(r io.Reader, path string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
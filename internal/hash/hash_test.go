@@ -3,19 +3,215 @@ package hash
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestCalcHashBytes(t *testing.T) {
 	assertions := require.New(t)
-	assertions.Equal("86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", calcHashBytes([]byte("a")))
+	assertions.Equal("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", calcHashBytes([]byte("a")))
 }
 
 func TestCalcHashFile(t *testing.T) {
 	assertions := require.New(t)
 	fileName := filepath.Join(t.TempDir(), "a")
 	assertions.NoError(os.WriteFile(fileName, []byte("a"), 0600))
-	assertions.Equal("86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", calcHashFile(fileName))
+	digest, err := calcHashFile(fileName)
+	assertions.NoError(err)
+	assertions.Equal("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", digest)
+	_, err = calcHashFile(fileName + ".missing")
+	assertions.Error(err)
+}
+
+func TestCalcHashes(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	files := make([]string, 0)
+	lines := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		name := "f" + strconv.Itoa(i)
+		assertions.NoError(os.WriteFile(filepath.Join(workDir, name), []byte(name), 0600))
+		files = append(files, name)
+		lines = append(lines, name+" "+calcHashBytes([]byte(name)))
+	}
+	fileHashes, err := CalcHashes(workDir, files)
+	assertions.NoError(err)
+	assertions.Equal(lines, fileHashes)
+
+	_, err = CalcHashes(workDir, append(files, "missing"))
+	assertions.Error(err)
+}
+
+func TestWalkDirWithPatterns(t *testing.T) {
+	assertions := require.New(t)
+	root := t.TempDir()
+	workDir := filepath.Join(root, "context")
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app"), 0755))
+	assertions.NoError(os.MkdirAll(filepath.Join(root, "shared"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "a.go"), []byte("a"), 0644))
+	assertions.NoError(os.WriteFile(filepath.Join(root, "shared", "b.go"), []byte("b"), 0644))
+	assertions.NoError(os.Symlink(filepath.Join(root, "shared"), filepath.Join(workDir, "shared")))
+
+	variants := []struct {
+		patterns []string
+		result   []string
+		err      string
+	}{
+		{patterns: []string{"**/*"}, result: []string{"app", "app/a.go", "shared"}},
+		{patterns: []string{"/app/*.go", "./app/*.go"}, result: []string{"app/a.go"}},
+		{patterns: []string{"shared/**/*"}, result: []string{}},
+		{patterns: []string{"app/../app/*.go"}, result: []string{"app/a.go"}},
+		{patterns: []string{"app"}, result: []string{"app", "app/a.go"}},
+		{patterns: []string{"./app", "shared"}, result: []string{"app", "app/a.go", "shared"}},
+		{patterns: []string{"../shared/**/*"}, err: "outside of the build context"},
+		{patterns: []string{"app/../../shared/*"}, err: "outside of the build context"},
+		{patterns: []string{".."}, err: "outside of the build context"},
+	}
+	for n, variant := range variants {
+		files, err := WalkDirWithPatterns(workDir, variant.patterns)
+		if variant.err != "" {
+			assertions.ErrorContains(err, variant.err, n)
+			continue
+		}
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, files, n)
+	}
+
+	_, err := WalkDirWithPatterns(filepath.Join(root, "missing"), []string{"**/*"})
+	assertions.Error(err)
+}
+
+func TestMatchPatterns(t *testing.T) {
+	assertions := require.New(t)
+	assertions.True(MatchPatterns("src/a/b.txt", []string{"src"}))
+	assertions.True(MatchPatterns("src/a/b.txt", []string{"**/a"}))
+	assertions.True(MatchPatterns("src/a/b.txt", []string{"src/*/*.txt"}))
+	assertions.False(MatchPatterns("src/a/b.txt", []string{"sr", "b.txt"}))
+}
+
+func TestCalcManifest(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "a"), []byte("a"), 0644))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "run.sh"), []byte("echo"), 0755))
+	assertions.NoError(os.Mkdir(filepath.Join(workDir, "empty"), 0755))
+	assertions.NoError(os.Symlink("../outside dir", filepath.Join(workDir, "link")))
+	files, err := WalkDirWithPatterns(workDir, []string{"**/*"})
+	assertions.NoError(err)
+	assertions.Equal([]string{"a", "empty", "link", "run.sh"}, files)
+
+	manifest, err := CalcManifest(workDir, files)
+	assertions.NoError(err)
+	assertions.Equal([]string{
+		"a " + calcHashBytes([]byte("a")),
+		"dir:empty -",
+		"symlink:link ../outside%20dir",
+		"run.sh " + calcHashBytes([]byte("echo")),
+		"mode:run.sh 0755",
+	}, manifest.Lines())
+	parsed, err := ParseManifest(manifest.String())
+	assertions.NoError(err)
+	assertions.Equal(manifest, parsed)
+
+	_, err = CalcManifest(workDir, []string{"missing"})
+	assertions.Error(err)
+}
+
+func TestManifest(t *testing.T) {
+	assertions := require.New(t)
+	manifest := FilesManifest([]string{"a b 1", "c 2"})
+	manifest = append(manifest, Entry{Kind: "from", Name: "x/y", Digest: "3"})
+	assertions.Equal([]string{"a b 1", "c 2", "from:x/y 3"}, manifest.Lines())
+	assertions.Equal("a b 1\nc 2\nfrom:x/y 3\n", manifest.String())
+
+	parsed, err := ParseManifest(manifest.String())
+	assertions.NoError(err)
+	assertions.Equal(manifest, parsed)
+	_, err = ParseManifest("a\n")
+	assertions.Error(err)
+}
+
+func TestDiff(t *testing.T) {
+	assertions := require.New(t)
+	old, _ := ParseManifest("a 1\nb 2\nc 3\nfrom:x 4\n")
+	new, _ := ParseManifest("d 5\na 1\nc 6\nfrom:x 7\n")
+	changes := Diff(old, new)
+	result := make([]string, 0)
+	for _, change := range changes {
+		result = append(result, change.String())
+	}
+	assertions.Equal([]string{"- file b 2", "~ file c 3 -> 6", "~ from x 4 -> 7", "+ file d 5"}, result)
+	assertions.Empty(Diff(old, old))
+}
+
+func TestFileCache(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	cacheFile := filepath.Join(workDir, "cache", "hashes.json")
+	fileName := filepath.Join(workDir, "a")
+	old := time.Now().Add(-time.Hour)
+	assertions.NoError(os.WriteFile(fileName, []byte("a"), 0600))
+	assertions.NoError(os.Chtimes(fileName, old, old))
+
+	c, err := LoadFileCache(cacheFile)
+	assertions.NoError(err)
+	digest, err := c.digest(fileName)
+	assertions.NoError(err)
+	assertions.Equal(calcHashBytes([]byte("a")), digest)
+	assertions.NoError(c.Save(cacheFile))
+
+	// a cached digest is used while the metadata of the file is the same
+	c, err = LoadFileCache(cacheFile)
+	assertions.NoError(err)
+	key, _ := filepath.Abs(fileName)
+	entry := c.entries[key]
+	entry.Digest = "cached"
+	c.entries[key] = entry
+	digest, err = c.digest(fileName)
+	assertions.NoError(err)
+	assertions.Equal("cached", digest)
+
+	// a changed modification time makes the file hashed again
+	newer := old.Add(time.Minute)
+	assertions.NoError(os.WriteFile(fileName, []byte("b"), 0600))
+	assertions.NoError(os.Chtimes(fileName, newer, newer))
+	digest, err = c.digest(fileName)
+	assertions.NoError(err)
+	assertions.Equal(calcHashBytes([]byte("b")), digest)
+
+	// a recently modified file is hashed every time and not cached
+	assertions.NoError(os.WriteFile(fileName, []byte("c"), 0600))
+	digest, err = c.digest(fileName)
+	assertions.NoError(err)
+	assertions.Equal(calcHashBytes([]byte("c")), digest)
+	_, ok := c.entries[key]
+	assertions.False(ok)
+
+	_, err = c.digest(fileName + ".missing")
+	assertions.Error(err)
+
+	assertions.NoError(os.WriteFile(cacheFile, []byte("{"), 0600))
+	_, err = LoadFileCache(cacheFile)
+	assertions.Error(err)
+}
+
+func TestCalcHashesWithCache(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a", "b"} {
+		assertions.NoError(os.WriteFile(filepath.Join(workDir, name), []byte(name), 0600))
+		assertions.NoError(os.Chtimes(filepath.Join(workDir, name), old, old))
+	}
+	HashCache = NewFileCache()
+	defer func() { HashCache = nil }()
+	first, err := CalcHashes(workDir, []string{"a", "b"})
+	assertions.NoError(err)
+	assertions.Len(HashCache.entries, 2)
+	second, err := CalcHashes(workDir, []string{"a", "b"})
+	assertions.NoError(err)
+	assertions.Equal(first, second)
 }
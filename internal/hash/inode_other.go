@@ -0,0 +1,10 @@
+//go:build !unix
+
+package hash
+
+import "io/fs"
+
+// inode is not known, the cache relies on the path, size and modification time.
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
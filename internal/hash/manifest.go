@@ -0,0 +1,175 @@
+package hash
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ManifestLabel is the image label keeping the Digest of the manifest of the image hash tag.
+const ManifestLabel = "sdb.manifest"
+
+// Entry is an input of a hash tag: a file with the digest of its content or
+// another input (Kind is not "file") with its value.
+type Entry struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// Manifest is the ordered list of inputs a hash tag is calculated from.
+type Manifest []Entry
+
+// Version is the "sdb:version" entry of manifests, it is increased when the same
+// inputs must give other hash tags (images are built by sdb differently).
+const Version = "1"
+
+var manifestKinds = []string{"from", "mode", "symlink", "dir", "env", "value", "config", "sdb"}
+
+// Key identifies the entry in Diff.
+func (e Entry) Key() string {
+	if e.Kind == "file" {
+		return e.Name
+	}
+	return e.Kind + ":" + e.Name
+}
+
+// Line is "path digest" for files and "kind:name value" for other inputs.
+func (e Entry) Line() string {
+	return e.Key() + " " + e.Digest
+}
+
+func (m Manifest) Lines() []string {
+	lines := make([]string, 0, len(m))
+	for _, entry := range m {
+		lines = append(lines, entry.Line())
+	}
+	return lines
+}
+
+// Public is the manifest with digests of env values replaced by "set", they may be
+// secrets and a digest of a short value is easily reversed. It is shown and saved,
+// only the hash tag and the Digest are calculated from env values.
+func (m Manifest) Public() Manifest {
+	public := make(Manifest, 0, len(m))
+	for _, entry := range m {
+		if entry.Kind == "env" && entry.Digest != "-" {
+			entry.Digest = "set"
+		}
+		public = append(public, entry)
+	}
+	return public
+}
+
+// Sum is the digest of the manifest, the hash tag is its prefix.
+func (m Manifest) Sum() string {
+	return calcHashBytes([]byte(m.String()))
+}
+
+// Digest is "sha256:" and the Sum, the manifest itself is too long for a label
+// (an argument of docker build) of a large build context.
+func (m Manifest) Digest() string {
+	return "sha256:" + m.Sum()
+}
+
+// SumWith is Sum calculated by the algorithm: sha256 (default) or sha512.
+func (m Manifest) SumWith(algorithm string) (string, error) {
+	switch algorithm {
+	case "", "sha256":
+		return m.Sum(), nil
+	case "sha512":
+		sum := sha512.Sum512([]byte(m.String()))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// String is the text the Sum is calculated from, one Line per entry.
+func (m Manifest) String() string {
+	var b strings.Builder
+	for _, entry := range m {
+		b.WriteString(entry.Line())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// FilesManifest makes the manifest of "path digest" lines of CalcHashes.
+func FilesManifest(fileHashes []string) Manifest {
+	m := make(Manifest, 0, len(fileHashes))
+	for _, line := range fileHashes {
+		idx := strings.LastIndex(line, " ")
+		m = append(m, Entry{Kind: "file", Name: line[:idx], Digest: line[idx+1:]})
+	}
+	return m
+}
+
+// ParseManifest reads the text of Manifest.String.
+func ParseManifest(text string) (Manifest, error) {
+	m := make(Manifest, 0)
+	for n, line := range strings.Split(text, "\n") {
+		if line == "" {
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		if idx <= 0 {
+			return nil, fmt.Errorf("manifest line %d: no digest in %q", n+1, line)
+		}
+		entry := Entry{Kind: "file", Name: line[:idx], Digest: line[idx+1:]}
+		for _, kind := range manifestKinds {
+			if strings.HasPrefix(entry.Name, kind+":") {
+				entry.Kind = kind
+				entry.Name = strings.TrimPrefix(entry.Name, kind+":")
+				break
+			}
+		}
+		m = append(m, entry)
+	}
+	return m, nil
+}
+
+// Change is a difference of two manifests: Old is empty for added inputs,
+// New is empty for removed ones.
+type Change struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == "":
+		return "+ " + c.Kind + " " + c.Name + " " + c.New
+	case c.New == "":
+		return "- " + c.Kind + " " + c.Name + " " + c.Old
+	}
+	return "~ " + c.Kind + " " + c.Name + " " + c.Old + " -> " + c.New
+}
+
+// Diff returns inputs added, removed or modified from old to new, removed and
+// modified ones in the order of old, then added ones in the order of new.
+func Diff(old, new Manifest) []Change {
+	newEntries := make(map[string]Entry, len(new))
+	for _, entry := range new {
+		newEntries[entry.Key()] = entry
+	}
+	oldKeys := make(map[string]bool, len(old))
+	changes := make([]Change, 0)
+	for _, entry := range old {
+		oldKeys[entry.Key()] = true
+		newEntry, ok := newEntries[entry.Key()]
+		if !ok {
+			changes = append(changes, Change{Kind: entry.Kind, Name: entry.Name, Old: entry.Digest})
+		} else if newEntry.Digest != entry.Digest {
+			changes = append(changes, Change{Kind: entry.Kind, Name: entry.Name, Old: entry.Digest, New: newEntry.Digest})
+		}
+	}
+	for _, entry := range new {
+		if !oldKeys[entry.Key()] {
+			changes = append(changes, Change{Kind: entry.Kind, Name: entry.Name, New: entry.Digest})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,129 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/abatalev/smartdockerbuild/internal/docker"
+)
+
+// Image is a Dockerfile of the run. References are names other Dockerfiles use
+// in FROM for the image, Upstream are names of local images it is built from.
+type Image struct {
+	DockerFile string
+	Name       string
+	References []string
+	From       []string
+	Upstream   []string
+}
+
+// GetFromImages returns repositories of FROM images, stages of the Dockerfile are skipped.
+func GetFromImages(workDir, dockerFile string) ([]string, error) {
+	f, err := os.Open(filepath.Join(workDir, dockerFile))
+	if err != nil {
+		return nil, err
+	}
+	_, dependencies, err := docker.ParseDockerFile(f, workDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dockerFile, err)
+	}
+	stages := make(map[string]bool)
+	images := make([]string, 0)
+	for _, dependency := range dependencies {
+		switch dependency.Type {
+		case "docker-stage":
+			stages[strings.ToLower(dependency.Value)] = true
+		case "docker-image":
+			if !stages[strings.ToLower(dependency.Value)] {
+				images = append(images, ImageRepository(dependency.Value))
+			}
+		}
+	}
+	return images, nil
+}
+
+// ImageRepository cuts the tag and the digest off the image reference.
+func ImageRepository(ref string) string {
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		ref = ref[:idx]
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		ref = ref[:idx]
+	}
+	return ref
+}
+
+// SortImages fills Upstream of images and orders them so that every image goes
+// after its upstream images. Independent images keep their order.
+func SortImages(images []Image) ([]Image, error) {
+	byReference := make(map[string]int)
+	for i, image := range images {
+		for _, ref := range append([]string{image.Name}, image.References...) {
+			if j, ok := byReference[ref]; ok && j != i {
+				return nil, fmt.Errorf("image %s is produced by %s and %s", ref,
+					images[j].DockerFile, image.DockerFile)
+			}
+			byReference[ref] = i
+		}
+	}
+
+	upstream := make([][]int, len(images))
+	for i := range images {
+		images[i].Upstream = nil
+		seen := make(map[int]bool)
+		for _, from := range images[i].From {
+			j, ok := byReference[from]
+			if !ok || seen[j] {
+				continue
+			}
+			if j == i {
+				return nil, fmt.Errorf("%s: image %s is built from itself", images[i].DockerFile, images[i].Name)
+			}
+			seen[j] = true
+			upstream[i] = append(upstream[i], j)
+			images[i].Upstream = append(images[i].Upstream, images[j].Name)
+		}
+		sort.Strings(images[i].Upstream)
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(images))
+	ordered := make([]Image, 0, len(images))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			for n, name := range path {
+				if name == images[i].Name {
+					path = path[n:]
+					break
+				}
+			}
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, images[i].Name), " -> "))
+		}
+		state[i] = visiting
+		for _, j := range upstream[i] {
+			if err := visit(j, append(path, images[i].Name)); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		ordered = append(ordered, images[i])
+		return nil
+	}
+	for i := range images {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
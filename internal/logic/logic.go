@@ -1,27 +1,75 @@
 package logic
 
 import (
-	"io"
+	"context"
+	"fmt"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 
 	"github.com/abatalev/smartdockerbuild/internal/docker"
 	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/osrunner"
+	"github.com/bmatcuk/doublestar"
 )
 
-func SemanticVersion(v string) []string {
-	a := strings.Split(v, ".")
-	versions := make([]string, 0)
-	x := ""
-	for _, v := range a {
-		if x == "" {
-			x = v
-		} else {
-			x = x + "." + v
+// Version is a version like v1.2.3-rc.1+build.5, Core holds the numbers 1, 2 and 3.
+type Version struct {
+	Prefix     string
+	Core       []string
+	Prerelease string
+	Build      string
+}
+
+// ParseVersion parses a SemVer like version, ok is false when the core is not numeric.
+func ParseVersion(v string) (Version, bool) {
+	version := Version{}
+	core := v
+	if strings.HasPrefix(core, "v") {
+		version.Prefix, core = "v", core[1:]
+	}
+	core, version.Build, _ = strings.Cut(core, "+")
+	core, version.Prerelease, _ = strings.Cut(core, "-")
+	version.Core = strings.Split(core, ".")
+	for _, part := range version.Core {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return Version{}, false
 		}
-		versions = append(versions, x)
+	}
+	return version, true
+}
+
+// versionDepths are depths of @fact:depth, the number of parts of the shortest version.
+var versionDepths = map[string]int{"major": 1, "minor": 2, "patch": 3}
+
+// ExpandVersion returns versions from depth parts of the core to the full core. A prerelease
+// is kept as a suffix and has no major only version (1.2-rc.1, 1.2.3-rc.1), build metadata
+// is dropped. A value which isn't a version is returned as is.
+func ExpandVersion(v string, depth int) []string {
+	version, ok := ParseVersion(v)
+	if !ok {
+		return []string{v}
+	}
+	suffix := ""
+	if version.Prerelease != "" {
+		suffix = "-" + version.Prerelease
+		if depth < 2 {
+			depth = 2
+		}
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > len(version.Core) {
+		depth = len(version.Core)
+	}
+	versions := make([]string, 0)
+	for n := depth; n <= len(version.Core); n++ {
+		versions = append(versions, version.Prefix+strings.Join(version.Core[:n], ".")+suffix)
 	}
 	return versions
 }
@@ -31,10 +79,25 @@ type Token struct {
 	Value []string
 }
 
+// TagsProcessing calls doTag for every tag of the mask, a mask giving an empty tag is an error.
 func TagsProcessing(mask string, facts map[string]string, doTag func(tag string) error) error {
+	if err := CheckMask(mask); err != nil {
+		return err
+	}
 	tokens := ParseMask(mask, facts)
+	if strings.Contains(mask, "{{") {
+		expr, _ := parseMaskExpr(mask)
+		var err error
+		if tokens, err = expr.tokens(facts); err != nil {
+			return err
+		}
+	}
 	for {
-		if err := doTag(GetTag(tokens)); err != nil {
+		tag := GetTag(tokens)
+		if tag == "" {
+			return fmt.Errorf("mask %q gives an empty tag", mask)
+		}
+		if err := doTag(tag); err != nil {
 			return err
 		}
 		if !NextTag(tokens) {
@@ -48,8 +111,8 @@ func ParseMask(mask string, facts map[string]string) []Token {
 	tokens := make([]Token, 0)
 	for _, ttt := range strings.Split(mask, "|") {
 		if strings.HasPrefix(ttt, "@") {
-			k := strings.TrimPrefix(ttt, "@")
-			tokens = append(tokens, Token{Value: SemanticVersion(facts[k])})
+			k, depth, _ := strings.Cut(strings.TrimPrefix(ttt, "@"), ":")
+			tokens = append(tokens, Token{Value: ExpandVersion(facts[k], versionDepths[depth])})
 			continue
 		}
 		if strings.HasPrefix(ttt, "$") {
@@ -97,31 +160,24 @@ func merge(a, b string) string {
 	return a + " " + quote(b)
 }
 
-func GetCmdChain(useEntryPoint bool, hash string, args []string) ([]*exec.Cmd, io.ReadCloser) {
+func GetCmdChain(useEntryPoint bool, hash, containerName string, args []string) osrunner.Pipeline {
 	cmdIdx := 0
-	cmds := make([]*exec.Cmd, 0)
-	var v []string
+	pipeline := osrunner.Pipeline{}
+	v := []string{"docker", "run", "--rm"}
+	if containerName != "" {
+		v = append(v, "--name", containerName)
+	}
 	if useEntryPoint {
-		v = []string{"docker", "run", "--rm", "--entrypoint", "/bin/sh", hash, "-c"}
+		v = append(v, "--entrypoint", "/bin/sh", hash, "-c")
 	} else {
-		v = []string{"docker", "run", "--rm", hash}
+		v = append(v, hash)
 	}
 	lv := len(v)
-	var prvCmd *exec.Cmd = nil
 	var prvPipe string = ""
 	for _, arg := range args {
 		if arg == "|" || arg == "|&" {
-			curCmd := exec.Command(v[0], v[1:]...)
-			if prvCmd != nil {
-				if prvPipe == "|" {
-					curCmd.Stdin, _ = prvCmd.StdoutPipe()
-				} else {
-					curCmd.Stdin, _ = prvCmd.StderrPipe()
-				}
-			}
-			prvCmd = curCmd
+			pipeline.Stages = append(pipeline.Stages, osrunner.Stage{Args: v, Pipe: prvPipe})
 			prvPipe = arg
-			cmds = append(cmds, curCmd)
 			cmdIdx += 1
 			v = make([]string, 0)
 		} else {
@@ -137,17 +193,17 @@ func GetCmdChain(useEntryPoint bool, hash string, args []string) ([]*exec.Cmd, i
 			}
 		}
 	}
-	cmd := exec.Command(v[0], v[1:]...)
-	if prvCmd != nil {
-		if prvPipe == "|" {
-			cmd.Stdin, _ = prvCmd.StdoutPipe()
-		} else {
-			cmd.Stdin, _ = prvCmd.StderrPipe()
-		}
+	pipeline.Stages = append(pipeline.Stages, osrunner.Stage{Args: v, Pipe: prvPipe})
+	return pipeline
+}
+
+// ListImages returns output of "docker image list" for FindImage.
+func ListImages(ctx context.Context, runner osrunner.Runner) (string, error) {
+	res, err := runner.Run(ctx, osrunner.NewPipeline("docker", "image", "list"))
+	if err != nil {
+		return "", err
 	}
-	cmds = append(cmds, cmd)
-	cmdOut, _ := cmd.StdoutPipe()
-	return cmds, cmdOut
+	return string(res.Stdout), nil
 }
 
 func FindImage(stdout string, project string, hash string) bool {
@@ -164,6 +220,62 @@ func FindImage(stdout string, project string, hash string) bool {
 	return false
 }
 
+// IsDockerFile tells whether GetImageName knows the file name pattern.
+func IsDockerFile(dockerFile string) bool {
+	baseName := filepath.Base(dockerFile)
+	if strings.HasSuffix(baseName, ".dockerignore") {
+		return false
+	}
+	return baseName == "Dockerfile" || strings.HasPrefix(baseName, "Dockerfile.") ||
+		strings.HasSuffix(baseName, ".Dockerfile")
+}
+
+// FindDockerFiles expands glob patterns (with ** support) and directories relative
+// to workDir. Plain names are kept as is, a pattern without Dockerfiles is an error.
+func FindDockerFiles(workDir string, patterns []string) ([]string, error) {
+	files := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		if info, err := os.Stat(filepath.Join(workDir, pattern)); err == nil && info.IsDir() {
+			pattern = filepath.Join(pattern, "**", "*")
+		}
+		if !strings.ContainsAny(pattern, "*?[{") {
+			if !seen[filepath.Clean(pattern)] {
+				seen[filepath.Clean(pattern)] = true
+				files = append(files, pattern)
+			}
+			continue
+		}
+		matches, err := doublestar.Glob(filepath.Join(workDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		found := make([]string, 0)
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() || !IsDockerFile(match) {
+				continue
+			}
+			rel, err := filepath.Rel(workDir, match)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, rel)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("%s: no Dockerfiles found", pattern)
+		}
+		sort.Strings(found)
+		for _, file := range found {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
 func GetImageName(dockerFile string) string {
 	// TODO bnd (project.go:CheckFile)
 	baseName := filepath.Base(dockerFile)
@@ -180,18 +292,197 @@ func GetImageName(dockerFile string) string {
 	panic("unknown pattern '" + dockerFile + "'") // TODO remove panic
 }
 
-func CalcHash(workDir, dockerFile string) string {
-	hash := hash.CalcHashFiles(hash.CalcHashes(workDir, GetFilesForDockerFile(workDir, dockerFile)))
-	return hash[:8]
+func CalcHash(workDir, dockerFile string) (string, error) {
+	hashTag, _, err := CalcHashInputs(workDir, dockerFile, nil)
+	return hashTag, err
+}
+
+// CalcHashInputs returns the hash tag and the manifest it was calculated from.
+func CalcHashInputs(workDir, dockerFile string, upstream map[string]string) (string, hash.Manifest, error) {
+	manifest, err := CalcManifest(workDir, dockerFile, upstream, HashInputs{})
+	if err != nil {
+		return "", nil, err
+	}
+	hashTag, err := HashFormat{}.HashTag(manifest, "", "")
+	return hashTag, manifest, err
 }
 
-func GetFilesForDockerFile(workDir, dockerFile string) []string {
-	f, _ := os.Open(filepath.Join(workDir, dockerFile))
-	// if err != nil {
-	// 	return []string{}, []docker.ProjectDependency{}, err
-	// }
-	files := []string{dockerFile}
-	patterns, _ := docker.ParseDockerFile(f, workDir)
-	files = append(files, patterns...)
-	return hash.WalkDirWithPatterns(workDir, files)
+// HashInputs are inputs of the hash besides the Dockerfile and COPY sources: Files
+// globs of the context, Env variables and literal Values. Exclude drops files.
+type HashInputs struct {
+	Files   []string `yaml:"files"`
+	Env     []string `yaml:"env"`
+	Values  []string `yaml:"values"`
+	Exclude []string `yaml:"-"`
+}
+
+// CalcManifest returns the manifest of the image of dockerFile. Hash tags of upstream
+// images (name -> hash tag) are added as "from" entries, so a change of an upstream
+// image changes the hash of the image. Variables are kept as digests of their values
+// ("-" if not set), they may be secrets: show and save only Manifest.Public. The manifest
+// ends with the sdb version entry.
+func CalcManifest(workDir, dockerFile string, upstream map[string]string, inputs HashInputs) (hash.Manifest, error) {
+	patterns, err := GetPatternsForDockerFile(workDir, dockerFile)
+	if err != nil {
+		return nil, err
+	}
+	found, err := hash.WalkDirWithPatterns(workDir, append(patterns, inputs.Files...))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := hash.CalcManifest(workDir, excludeFiles(workDir, dockerFile, found, inputs.Exclude))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(upstream))
+	for name := range upstream {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		manifest = append(manifest, hash.Entry{Kind: "from", Name: name, Digest: upstream[name]})
+	}
+	for _, name := range inputs.Env {
+		digest := "-"
+		if value, ok := os.LookupEnv(name); ok {
+			digest = hash.DigestValue(value)
+		}
+		manifest = append(manifest, hash.Entry{Kind: "env", Name: name, Digest: digest})
+	}
+	for _, value := range inputs.Values {
+		manifest = append(manifest, hash.Entry{Kind: "value", Name: hash.EscapeValue(value), Digest: "-"})
+	}
+	return append(manifest, hash.Entry{Kind: "sdb", Name: "version", Digest: hash.Version}), nil
+}
+
+// excludeFiles drops files matching exclude and directories with all their content excluded
+// (an empty directory is kept), the Dockerfile is never excluded. Files are in the walk order,
+// so the content of a directory is checked before the directory going backwards.
+func excludeFiles(workDir, dockerFile string, files, exclude []string) []string {
+	if len(exclude) == 0 {
+		return files
+	}
+	total := make(map[string]int)
+	kept := make(map[string]int)
+	isKept := make([]bool, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		isKept[i] = file == dockerFile || !hash.MatchPatterns(file, exclude)
+		if total[file] > 0 && kept[file] == 0 {
+			if info, err := os.Lstat(filepath.Join(workDir, file)); err == nil && info.IsDir() {
+				isKept[i] = false
+			}
+		}
+		for dir := path.Dir(file); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			total[dir]++
+			if isKept[i] {
+				kept[dir]++
+			}
+		}
+	}
+	result := make([]string, 0, len(files))
+	for i, file := range files {
+		if isKept[i] {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// HashFormat makes the hash tag of a manifest: Length (8 by default) hex chars of
+// its Algorithm digest put into the Tag template with .Name, .Hash and .Target.
+type HashFormat struct {
+	Algorithm string `yaml:"algorithm"`
+	Length    int    `yaml:"length"`
+	Tag       string `yaml:"tag"`
+}
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+func (f HashFormat) HashTag(manifest hash.Manifest, name, target string) (string, error) {
+	sum, err := manifest.SumWith(f.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	length := f.Length
+	if length == 0 {
+		length = 8
+	}
+	if length < 4 || length > len(sum) {
+		return "", fmt.Errorf("hash length %d is out of range 4..%d", length, len(sum))
+	}
+	if f.Tag == "" {
+		return sum[:length], nil
+	}
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(f.Tag)
+	if err != nil {
+		return "", fmt.Errorf("hash tag template: %w", err)
+	}
+	var b strings.Builder
+	data := struct{ Name, Hash, Target string }{Name: name, Hash: sum[:length], Target: target}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("hash tag template: %w", err)
+	}
+	hashTag := b.String()
+	if !strings.Contains(hashTag, sum[:length]) {
+		return "", fmt.Errorf("hash tag template %q has no {{.Hash}}", f.Tag)
+	}
+	if !tagPattern.MatchString(hashTag) {
+		return "", fmt.Errorf("hash tag %q is not a valid docker tag", hashTag)
+	}
+	return hashTag, nil
+}
+
+func GetFilesForDockerFile(workDir, dockerFile string) ([]string, error) {
+	patterns, err := GetPatternsForDockerFile(workDir, dockerFile)
+	if err != nil {
+		return nil, err
+	}
+	return hash.WalkDirWithPatterns(workDir, patterns)
+}
+
+// UnmatchedSources returns COPY and ADD sources of the Dockerfile matching no files
+// of the build context, docker build would fail on them.
+func UnmatchedSources(workDir, dockerFile string) ([]docker.Source, error) {
+	f, err := os.Open(filepath.Join(workDir, dockerFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sources, err := docker.ParseSources(f)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0, len(sources))
+	for _, source := range sources {
+		patterns = append(patterns, source.Pattern)
+	}
+	unmatchedPatterns, err := hash.UnmatchedPatterns(workDir, patterns)
+	if err != nil {
+		return nil, err
+	}
+	isUnmatched := make(map[string]bool)
+	for _, pattern := range unmatchedPatterns {
+		isUnmatched[pattern] = true
+	}
+	unmatched := make([]docker.Source, 0)
+	for _, source := range sources {
+		if isUnmatched[source.Pattern] {
+			unmatched = append(unmatched, source)
+		}
+	}
+	return unmatched, nil
+}
+
+// GetPatternsForDockerFile returns the Dockerfile and patterns of its COPY and ADD sources.
+func GetPatternsForDockerFile(workDir, dockerFile string) ([]string, error) {
+	f, err := os.Open(filepath.Join(workDir, dockerFile))
+	if err != nil {
+		return nil, err
+	}
+	patterns, _, err := docker.ParseDockerFile(f, workDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dockerFile, err)
+	}
+	return append([]string{dockerFile}, patterns...), nil
 }
@@ -1,27 +1,44 @@
 package logic
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/abatalev/smartdockerbuild/internal/docker"
 	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/osrunner"
 	"github.com/stretchr/testify/require"
 )
 
-func TestSemanticVersion(t *testing.T) {
+func TestExpandVersion(t *testing.T) {
 	variants := []struct {
 		value  string
+		depth  int
 		result []string
 	}{
-		{value: "1", result: []string{"1"}},
-		{value: "1.0.2", result: []string{"1", "1.0", "1.0.2"}},
+		{value: "1.2.3", depth: 2, result: []string{"1.2", "1.2.3"}},
+		{value: "1.2.3", depth: 3, result: []string{"1.2.3"}},
+		{value: "1.2", depth: 3, result: []string{"1.2"}},
+		{value: "1.2.3-rc.1", depth: 3, result: []string{"1.2.3-rc.1"}},
+		{value: "1.2.3", depth: 0, result: []string{"1", "1.2", "1.2.3"}},
+		{value: "1", depth: 1, result: []string{"1"}},
+		{value: "1.0.2", depth: 1, result: []string{"1", "1.0", "1.0.2"}},
+		{value: "v1.2.3", depth: 1, result: []string{"v1", "v1.2", "v1.2.3"}},
+		{value: "17.0.2+8", depth: 1, result: []string{"17", "17.0", "17.0.2"}},
+		{value: "3.21.0-r1", depth: 1, result: []string{"3.21-r1", "3.21.0-r1"}},
+		{value: "1.2.3-beta.1", depth: 1, result: []string{"1.2-beta.1", "1.2.3-beta.1"}},
+		{value: "1.2.3-rc.1+exp.sha.5114f85", depth: 1, result: []string{"1.2-rc.1", "1.2.3-rc.1"}},
+		{value: "17-ea", depth: 1, result: []string{"17-ea"}},
+		{value: "bookworm", depth: 1, result: []string{"bookworm"}},
+		{value: "1..2", depth: 1, result: []string{"1..2"}},
 	}
 	assertions := require.New(t)
 	for n, variant := range variants {
-		assertions.ElementsMatch(variant.result, SemanticVersion(variant.value), n)
+		assertions.Equal(variant.result, ExpandVersion(variant.value, variant.depth), n)
 	}
 }
 
@@ -49,6 +66,10 @@ func TestTags(t *testing.T) {
 				"1-alpine3.20.1", "1-alpine3.20", "1-alpine3",
 			},
 		},
+		{
+			mask:       "$app-version|-alpine|@os-version:minor",
+			resultTags: []string{"1.0.0-alpine3.20.1", "1.0.0-alpine3.20"},
+		},
 	}
 	for n, variant := range variants {
 		tags := make([]string, 0)
@@ -61,6 +82,64 @@ func TestTags(t *testing.T) {
 	}
 }
 
+func TestMaskExpressions(t *testing.T) {
+	facts := map[string]string{"os-name": "Alpine Linux", "os_version": "3.20.1", "branch": "feature/ABC-1"}
+	assertions := require.New(t)
+
+	variants := []struct {
+		mask       string
+		resultTags []string
+		err        string
+	}{
+		{mask: `{{ .os-name | lower | replace " " "-" }}`, resultTags: []string{"alpine-linux"}},
+		{mask: `{{ .os_name | upper | trunc 3 }}-{{ semver .os_version "major.minor" }}`,
+			resultTags: []string{"ALP-3.20"}},
+		{mask: `v{{ .os_version | semver "major" }}`, resultTags: []string{"v3"}},
+		{mask: `{{ .branch | sanitize | lower }}`, resultTags: []string{"feature-abc-1"}},
+		{mask: `{{ .branch | regex "([A-Z]+-[0-9]+)" }}`, resultTags: []string{"ABC-1"}},
+		{mask: `{{ .branch | regex "^release/(.*)" | default "dev" }}`, resultTags: []string{"dev"}},
+		{mask: `{{ .missing | default "latest" }}`, resultTags: []string{"latest"}},
+		{mask: `{{ .os_version | expand }}-alpine`,
+			resultTags: []string{"3.20.1-alpine", "3.20-alpine", "3-alpine"}},
+		{mask: `{{ .os_version | expand "minor" }}`, resultTags: []string{"3.20.1", "3.20"}},
+		{mask: `{{ expand .os_version "patch" }}`, resultTags: []string{"3.20.1"}},
+		{mask: `{{ .missing }}`, err: "empty tag"},
+		{mask: `{{ .os-name | expand "minor" "patch" }}`, err: "col 15: expand needs 0 to 1 arguments, got 2"},
+		{mask: `{{ .os-name | expand "build" }}`, err: `col 22: expand: unknown version depth "build"`},
+		{mask: `$os-name|-|@os-version:micro`, err: `col 24: unknown version depth "micro"`},
+		{mask: `{{ .os-name | semver "major" }}`, err: `col 15: semver: "Alpine Linux" is not a version`},
+		{mask: `{{ .os-name | lower`, err: "col 20: unclosed action"},
+		{mask: `{{ .os-name | tolower }}`, err: `col 15: unknown function "tolower"`},
+		{mask: `{{ .os-name | trunc "x" }}`, err: `col 21: trunc: length "x" is not a number`},
+		{mask: `{{ .os-name | regex "(" }}`, err: "col 21: regex: error parsing regexp"},
+		{mask: `{{ .os-name | replace "a" }}`, err: "col 15: replace needs 2 arguments, got 1"},
+		{mask: `{{ .os-name | }}`, err: "col 15: expected a filter"},
+		{mask: `{{ "abc }}`, err: "col 4: unterminated string"},
+		{mask: `{{ . }}`, err: "col 4: expected a fact name after ."},
+		{mask: `{{ .a .b }}`, err: `col 7: unexpected ".", expected | or }}`},
+	}
+	for n, variant := range variants {
+		tags := make([]string, 0)
+		err := TagsProcessing(variant.mask, facts,
+			func(tagName string) error {
+				tags = append(tags, tagName)
+				return nil
+			})
+		if variant.err != "" {
+			assertions.ErrorContains(err, variant.err, n)
+			continue
+		}
+		assertions.NoError(err, n)
+		assertions.NoError(CheckMask(variant.mask), n)
+		assertions.ElementsMatch(variant.resultTags, tags, n)
+	}
+
+	var maskErr *MaskError
+	assertions.ErrorAs(CheckMask("{{ .a | x }}"), &maskErr)
+	assertions.Equal(8, maskErr.Pos)
+	assertions.NoError(CheckMask("$a|-|@b"))
+}
+
 func TestQuote(t *testing.T) {
 	variants := []struct {
 		value  string
@@ -92,6 +171,7 @@ func TestMerge(t *testing.T) {
 
 func TestGetCmdChain(t *testing.T) {
 	variants := []struct {
+		name   string
 		args   []string
 		result []string
 	}{
@@ -107,13 +187,18 @@ func TestGetCmdChain(t *testing.T) {
 			args:   []string{"1", "2", "|", "3"},
 			result: []string{"docker run --rm --entrypoint /bin/sh a -c 1 2", "3"},
 		},
+		{
+			name:   "sdb-fact-1",
+			args:   []string{"1", "|", "2"},
+			result: []string{"docker run --rm --name sdb-fact-1 --entrypoint /bin/sh a -c 1", "2"},
+		},
 	}
 	for n, variant := range variants {
-		cmds, _ := GetCmdChain(true, "a", variant.args)
+		pipeline := GetCmdChain(true, "a", variant.name, variant.args)
 		assertions := require.New(t)
 		cmdargs := make([]string, 0)
-		for _, cmd := range cmds {
-			cmdargs = append(cmdargs, strings.Join(cmd.Args, " "))
+		for _, stage := range pipeline.Stages {
+			cmdargs = append(cmdargs, strings.Join(stage.Args, " "))
 		}
 		assertions.ElementsMatch(variant.result, cmdargs, n)
 	}
@@ -138,6 +223,311 @@ func TestFindImage(t *testing.T) {
 	}
 }
 
+func TestGetCmdChainPipes(t *testing.T) {
+	assertions := require.New(t)
+	pipeline := GetCmdChain(false, "a", "", []string{"1", "|&", "2", "|", "3"})
+	assertions.Equal([]osrunner.Stage{
+		{Args: []string{"docker", "run", "--rm", "a", "1"}},
+		{Args: []string{"2"}, Pipe: "|&"},
+		{Args: []string{"3"}, Pipe: "|"},
+	}, pipeline.Stages)
+}
+
+func TestFindDockerFiles(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	for _, name := range []string{"images/a/Dockerfile", "images/b/Dockerfile.b", "images/b/Dockerfile.b.dockerignore",
+		"images/c/c.Dockerfile", "images/c/readme.md", "Dockerfile.x"} {
+		assertions.NoError(os.MkdirAll(filepath.Dir(filepath.Join(workDir, name)), 0755))
+		assertions.NoError(os.WriteFile(filepath.Join(workDir, name), []byte("FROM alpine\n"), 0644))
+	}
+	variants := []struct {
+		patterns []string
+		result   []string
+		err      bool
+	}{
+		{patterns: []string{"Dockerfile.x"}, result: []string{"Dockerfile.x"}},
+		{patterns: []string{"Dockerfile.y"}, result: []string{"Dockerfile.y"}},
+		{
+			patterns: []string{"images/**/*"},
+			result:   []string{"images/a/Dockerfile", "images/b/Dockerfile.b", "images/c/c.Dockerfile"},
+		},
+		{
+			patterns: []string{"images/b/Dockerfile.b", "images/*/Dockerfile*", "Dockerfile.x"},
+			result:   []string{"images/b/Dockerfile.b", "images/a/Dockerfile", "Dockerfile.x"},
+		},
+		{patterns: []string{"images/c"}, result: []string{"images/c/c.Dockerfile"}},
+		{patterns: []string{"images/**/*.yaml"}, err: true},
+	}
+	for n, variant := range variants {
+		files, err := FindDockerFiles(workDir, variant.patterns)
+		assertions.Equal(variant.err, err != nil, n)
+		if !variant.err {
+			assertions.Equal(variant.result, files, n)
+		}
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	variants := []struct {
+		value  string
+		result string
+	}{
+		{value: "alpine", result: "alpine"},
+		{value: "company/base:1.2", result: "company/base"},
+		{value: "localhost:5000/base", result: "localhost:5000/base"},
+		{value: "localhost:5000/base:1@sha256:abc", result: "localhost:5000/base"},
+	}
+	assertions := require.New(t)
+	for n, variant := range variants {
+		assertions.Equal(variant.result, ImageRepository(variant.value), n)
+	}
+}
+
+func TestGetFromImages(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile.a"),
+		[]byte("FROM company/base:1 AS build\nFROM build\nFROM alpine:3.20\n"), 0644))
+	images, err := GetFromImages(workDir, "Dockerfile.a")
+	assertions.NoError(err)
+	assertions.Equal([]string{"company/base", "alpine"}, images)
+	_, err = GetFromImages(workDir, "Dockerfile.b")
+	assertions.Error(err)
+}
+
+func TestSortImages(t *testing.T) {
+	variants := []struct {
+		images []Image
+		result []string
+		err    bool
+	}{
+		{
+			images: []Image{
+				{Name: "app", From: []string{"r/company/base", "alpine"}},
+				{Name: "tool"},
+				{Name: "company/base", References: []string{"r/company/base"}, From: []string{"os"}},
+				{Name: "os"},
+			},
+			result: []string{"os", "company/base: os", "app: company/base", "tool"},
+		},
+		{
+			images: []Image{{Name: "a", From: []string{"b"}}, {Name: "b", From: []string{"c"}}, {Name: "c", From: []string{"b"}}},
+			err:    true,
+		},
+		{images: []Image{{Name: "a", From: []string{"a"}}}, err: true},
+		{images: []Image{{Name: "a"}, {Name: "a"}}, err: true},
+	}
+	assertions := require.New(t)
+	for n, variant := range variants {
+		images, err := SortImages(variant.images)
+		assertions.Equal(variant.err, err != nil, n)
+		if variant.err {
+			continue
+		}
+		result := make([]string, 0)
+		for _, image := range images {
+			if len(image.Upstream) == 0 {
+				result = append(result, image.Name)
+			} else {
+				result = append(result, image.Name+": "+strings.Join(image.Upstream, " "))
+			}
+		}
+		assertions.Equal(variant.result, result, n)
+	}
+}
+
+func TestCalcHashInputsUpstream(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile.a"), []byte("FROM b:1\n"), 0644))
+	hashTag, _, err := CalcHashInputs(workDir, "Dockerfile.a", nil)
+	assertions.NoError(err)
+	hashTag2, err := CalcHash(workDir, "Dockerfile.a")
+	assertions.NoError(err)
+	assertions.Equal(hashTag2, hashTag)
+	hash1, manifest, _ := CalcHashInputs(workDir, "Dockerfile.a", map[string]string{"b": "11111111"})
+	hash2, _, _ := CalcHashInputs(workDir, "Dockerfile.a", map[string]string{"b": "22222222"})
+	assertions.NotEqual(hashTag, hash1)
+	assertions.NotEqual(hash1, hash2)
+	assertions.Contains(manifest.Lines(), "from:b 11111111")
+}
+
+func TestCalcHashInputsMetadata(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"),
+		[]byte("FROM alpine\nCOPY app/ /opt/app/\n"), 0644))
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app", "data"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "run.sh"), []byte("echo"), 0644))
+	hashTag, manifest, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.Contains(manifest.Lines(), "dir:app/data -")
+
+	assertions.NoError(os.Chmod(filepath.Join(workDir, "app", "run.sh"), 0755))
+	execHash, _, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.NotEqual(hashTag, execHash)
+
+	assertions.NoError(os.Symlink("run.sh", filepath.Join(workDir, "app", "start")))
+	linkHash, _, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.NotEqual(execHash, linkHash)
+	assertions.NoError(os.Remove(filepath.Join(workDir, "app", "start")))
+	assertions.NoError(os.Symlink("data", filepath.Join(workDir, "app", "start")))
+	retargetHash, _, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.NotEqual(linkHash, retargetHash)
+}
+
+func TestCalcManifestHashInputs(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app"), 0755))
+	for name, content := range map[string]string{
+		"Dockerfile": "FROM alpine\nCOPY app/ /opt/app/\n", "app/main.sh": "echo", "app/debug.log": "1", "go.sum": "x",
+	} {
+		assertions.NoError(os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644))
+	}
+	t.Setenv("SDB_TEST_PIN", "secret")
+	inputs := HashInputs{Files: []string{"go.sum"}, Env: []string{"SDB_TEST_PIN", "SDB_TEST_UNSET"},
+		Values: []string{"node 20"}, Exclude: []string{"**/*.log", "Dockerfile"}}
+	manifest, err := CalcManifest(workDir, "Dockerfile", nil, inputs)
+	assertions.NoError(err)
+	keys := make([]string, 0, len(manifest))
+	for _, entry := range manifest {
+		keys = append(keys, entry.Key())
+	}
+	assertions.Equal([]string{"Dockerfile", "app/main.sh", "go.sum", "env:SDB_TEST_PIN", "env:SDB_TEST_UNSET",
+		"value:node%2020", "sdb:version"}, keys)
+	assertions.Equal(hash.DigestValue("secret"), manifest[3].Digest)
+	assertions.Equal("-", manifest[4].Digest)
+	assertions.Equal("set", manifest.Public()[3].Digest)
+	assertions.Equal("-", manifest.Public()[4].Digest)
+
+	t.Setenv("SDB_TEST_PIN", "other")
+	changed, err := CalcManifest(workDir, "Dockerfile", nil, inputs)
+	assertions.NoError(err)
+	assertions.NotEqual(manifest.Sum(), changed.Sum())
+
+	_, err = CalcManifest(workDir, "Dockerfile", nil, HashInputs{Files: []string{"../go.sum"}})
+	assertions.ErrorContains(err, "outside of the build context")
+
+	_, err = CalcManifest(workDir, "Dockerfile.missing", nil, HashInputs{})
+	assertions.True(errors.Is(err, os.ErrNotExist))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile.long"),
+		[]byte("FROM alpine\nCOPY "+strings.Repeat("a", 2*1024*1024)+" /\n"), 0644))
+	_, err = CalcManifest(workDir, "Dockerfile.long", nil, HashInputs{})
+	assertions.ErrorContains(err, "Dockerfile.long")
+}
+
+func TestCalcManifestExcludeDirs(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app", "empty"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"), []byte("FROM alpine\nCOPY app/ /app/\n"), 0644))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "main.py"), []byte("print()"), 0644))
+	inputs := HashInputs{Exclude: []string{"**/__pycache__/**", "**/*.log"}}
+	manifest, err := CalcManifest(workDir, "Dockerfile", nil, inputs)
+	assertions.NoError(err)
+	assertions.Contains(manifest.Lines(), "dir:app/empty -")
+
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app", "__pycache__"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "__pycache__", "main.pyc"), []byte("1"), 0644))
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "app", "logs", "old"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "logs", "old", "a.log"), []byte("1"), 0644))
+	changed, err := CalcManifest(workDir, "Dockerfile", nil, inputs)
+	assertions.NoError(err)
+	assertions.Equal(manifest.Lines(), changed.Lines())
+
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "app", "logs", "readme.md"), []byte("1"), 0644))
+	changed, err = CalcManifest(workDir, "Dockerfile", nil, inputs)
+	assertions.NoError(err)
+	assertions.Contains(changed.Lines(), "dir:app/logs -")
+	assertions.NotContains(changed.Lines(), "dir:app/logs/old -")
+}
+
+func TestUnmatchedSources(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "cmd"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "cmd", "main.go"), []byte("package main"), 0644))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"),
+		[]byte("FROM golang\nCOPY go.mod go.sum /src/\nCOPY cmd/ /src/cmd/\nADD *.tgz /\n"), 0644))
+	unmatched, err := UnmatchedSources(workDir, "Dockerfile")
+	assertions.NoError(err)
+	assertions.Equal([]docker.Source{
+		{Line: 2, Instruction: "COPY", Path: "go.mod", Pattern: "go.mod"},
+		{Line: 2, Instruction: "COPY", Path: "go.sum", Pattern: "go.sum"},
+		{Line: 4, Instruction: "ADD", Path: "*.tgz", Pattern: "*.tgz"},
+	}, unmatched)
+
+	// a directory source matches with its content, which is hashed too
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"), []byte("FROM golang\nCOPY cmd /x\n"), 0644))
+	unmatched, err = UnmatchedSources(workDir, "Dockerfile")
+	assertions.NoError(err)
+	assertions.Empty(unmatched)
+	files, err := GetFilesForDockerFile(workDir, "Dockerfile")
+	assertions.NoError(err)
+	assertions.Equal([]string{"Dockerfile", "cmd", "cmd/main.go"}, files)
+
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"), []byte("FROM golang\nCOPY ../go.mod /\n"), 0644))
+	_, err = UnmatchedSources(workDir, "Dockerfile")
+	assertions.ErrorContains(err, "outside of the build context")
+}
+
+func TestCalcHashDirectorySource(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "src", "pkg"), 0755))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "src", "pkg", "a.txt"), []byte("a"), 0644))
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "Dockerfile"),
+		[]byte("FROM alpine\nCOPY src /app/src\n"), 0644))
+	hashTag, manifest, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.Contains(manifest.Lines(), "src/pkg/a.txt "+hash.DigestValue("a"))
+
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "src", "pkg", "a.txt"), []byte("b"), 0644))
+	changed, _, err := CalcHashInputs(workDir, "Dockerfile", nil)
+	assertions.NoError(err)
+	assertions.NotEqual(hashTag, changed)
+}
+
+func TestHashFormat(t *testing.T) {
+	assertions := require.New(t)
+	manifest := hash.Manifest{{Kind: "file", Name: "Dockerfile", Digest: "1"}}
+	sum := manifest.Sum()
+	sum512, err := manifest.SumWith("sha512")
+	assertions.NoError(err)
+	variants := []struct {
+		format HashFormat
+		result string
+		err    string
+	}{
+		{format: HashFormat{}, result: sum[:8]},
+		{format: HashFormat{Length: 12}, result: sum[:12]},
+		{format: HashFormat{Algorithm: "sha512", Length: 128}, result: sum512},
+		{format: HashFormat{Tag: "h-{{.Hash}}"}, result: "h-" + sum[:8]},
+		{format: HashFormat{Tag: "{{.Target}}-{{.Hash}}"}, result: "app-" + sum[:8]},
+		{format: HashFormat{Algorithm: "md5"}, err: "unknown hash algorithm"},
+		{format: HashFormat{Length: 2}, err: "out of range 4..64"},
+		{format: HashFormat{Length: 65}, err: "out of range 4..64"},
+		{format: HashFormat{Tag: "{{.Hash"}, err: "hash tag template"},
+		{format: HashFormat{Tag: "{{.Image}}-{{.Hash}}"}, err: "hash tag template"},
+		{format: HashFormat{Tag: "{{.Target}}"}, err: "has no {{.Hash}}"},
+		{format: HashFormat{Tag: "{{.Name}}-{{.Hash}}"}, err: "not a valid docker tag"},
+	}
+	for n, variant := range variants {
+		hashTag, err := variant.format.HashTag(manifest, "company/app", "app")
+		if variant.err != "" {
+			assertions.ErrorContains(err, variant.err, n)
+			continue
+		}
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, hashTag, n)
+	}
+}
+
 func TestGetImageName(t *testing.T) {
 	variants := []struct {
 		value  string
@@ -176,8 +566,8 @@ func TestCalcHash(t *testing.T) {
 				{FileName: "Dockerfile", Content: "FROM alpine:latest"},
 			},
 			resultFiles:      []string{"Dockerfile"},
-			resultFileHashes: []string{"Dockerfile 47e00eaac9bbcb2764b1608a7e17ceba481cdcbb"},
-			result:           "3ec05fad",
+			resultFileHashes: []string{"Dockerfile 95ddede6b9b8c4e90472db3acd0a8d28d1c822c998094ec8c594837d2b7b42ea"},
+			result:           "7d63c260",
 		},
 		{
 			dockerFile: "Dockerfile",
@@ -187,9 +577,9 @@ func TestCalcHash(t *testing.T) {
 			},
 			resultFiles: []string{"Dockerfile", "app.sh"},
 			resultFileHashes: []string{
-				"Dockerfile b0653e09926cf5a68a555c872b6bcf7a989c30ed",
-				"app.sh 9af03f3e531f0be9ae7c8379767f41089f474da4"},
-			result: "084fb41f",
+				"Dockerfile bc4c73cfef2cda99b5f06b658c96848e337c3282d262fcc5872301ee0060c224",
+				"app.sh f842137ade2104a92caaa0334f54f71c39a29027b1a7b27e72d77ea1b98559a1"},
+			result: "852cf30d",
 		},
 		{
 			dockerFile: "Dockerfile",
@@ -199,9 +589,9 @@ func TestCalcHash(t *testing.T) {
 			},
 			resultFiles: []string{"Dockerfile", "app.sh"},
 			resultFileHashes: []string{
-				"Dockerfile b0653e09926cf5a68a555c872b6bcf7a989c30ed",
-				"app.sh ed889a228dbaf4aa6febb6e2a8b72e1de11ce17f"},
-			result: "8ce8f799",
+				"Dockerfile bc4c73cfef2cda99b5f06b658c96848e337c3282d262fcc5872301ee0060c224",
+				"app.sh af0d5a0f7a1733f222cef36b408ddf870dded13b476bf925182a7ed09c7c66f5"},
+			result: "6a5e6786",
 		},
 		{
 			dockerFile: "Dockerfile",
@@ -212,10 +602,10 @@ func TestCalcHash(t *testing.T) {
 			},
 			resultFiles: []string{"Dockerfile", "file1.go", "file2.go"},
 			resultFileHashes: []string{
-				"Dockerfile 39ba751caaafe740a9cf96e5d5a2f9a793fe98a0",
-				"file1.go 7e240de74fb1ed08fa08d38063f6a6a91462a815",
-				"file2.go 5cb138284d431abd6a053a56625ec088bfb88912"},
-			result: "3f9974ce",
+				"Dockerfile 1066183df9c1615cba719f44e3973b531aa800efc3f22ea4aafda62b9213f9c4",
+				"file1.go 9834876dcfb05cb167a5c24953eba58c4ac89b1adf57f28f2f9d09af107ee8f0",
+				"file2.go 3e744b9dc39389baf0c5a0660589b8402f3dbb49b89b3e75f2c9355852a3c677"},
+			result: "317cc68d",
 		},
 		// {
 		// 	dockerFile: "Dockerfile",
@@ -227,8 +617,8 @@ func TestCalcHash(t *testing.T) {
 		// 	},
 		// 	resultFiles: []string{"Dockerfile", "file1.go"},
 		// 	resultFileHashes: []string{
-		// 		"Dockerfile 39ba751caaafe740a9cf96e5d5a2f9a793fe98a0",
-		// 		"file1.go 7e240de74fb1ed08fa08d38063f6a6a91462a815"},
+		// 		"Dockerfile 1066183df9c1615cba719f44e3973b531aa800efc3f22ea4aafda62b9213f9c4",
+		// 		"file1.go 9834876dcfb05cb167a5c24953eba58c4ac89b1adf57f28f2f9d09af107ee8f0"},
 		// 	result: "111",
 		// },
 		// {
@@ -241,8 +631,8 @@ func TestCalcHash(t *testing.T) {
 		// 	},
 		// 	resultFiles: []string{"Dockerfile", "file1.go"},
 		// 	resultFileHashes: []string{
-		// 		"Dockerfile 39ba751caaafe740a9cf96e5d5a2f9a793fe98a0",
-		// 		"file1.go 7e240de74fb1ed08fa08d38063f6a6a91462a815"},
+		// 		"Dockerfile 1066183df9c1615cba719f44e3973b531aa800efc3f22ea4aafda62b9213f9c4",
+		// 		"file1.go 9834876dcfb05cb167a5c24953eba58c4ac89b1adf57f28f2f9d09af107ee8f0"},
 		// 	result: "111",
 		// },
 	}
@@ -254,9 +644,14 @@ func TestCalcHash(t *testing.T) {
 			fileName := filepath.Join(dirName, f.FileName)
 			assertions.NoError(os.WriteFile(fileName, []byte(f.Content), 0600))
 		}
-		files := GetFilesForDockerFile(dirName, variant.dockerFile)
+		files, err := GetFilesForDockerFile(dirName, variant.dockerFile)
+		assertions.NoError(err, n)
 		assertions.ElementsMatch(variant.resultFiles, files, n)
-		assertions.ElementsMatch(variant.resultFileHashes, hash.CalcHashes(dirName, files), n)
-		assertions.Equal(variant.result, CalcHash(dirName, variant.dockerFile), n)
+		fileHashes, err := hash.CalcHashes(dirName, files)
+		assertions.NoError(err, n)
+		assertions.ElementsMatch(variant.resultFileHashes, fileHashes, n)
+		hashTag, err := CalcHash(dirName, variant.dockerFile)
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, hashTag, n)
 	}
 }
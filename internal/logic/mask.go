@@ -0,0 +1,424 @@
+package logic
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Masks with "{{" are expressions: text with actions like {{ .os-name | lower }} or
+// {{ semver .os-version "major.minor" }}. An action is an operand (.fact, "string"
+// or number) or a function call, followed by filters. The value of a function is
+// its first argument, a filter gets the value from the left of "|".
+
+// MaskError is a syntax error of a mask, Pos is the byte offset in the mask.
+type MaskError struct {
+	Mask    string
+	Pos     int
+	Message string
+}
+
+func (e *MaskError) Error() string {
+	return fmt.Sprintf("mask %q: col %d: %s", e.Mask, e.Pos+1, e.Message)
+}
+
+// maskFunc takes args arguments and up to optional more after the value.
+type maskFunc struct {
+	args     int
+	optional int
+	check    func(arg string) error
+	call     func(value string, args []string) ([]string, error)
+}
+
+var sanitizePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+var maskFuncs = map[string]maskFunc{
+	"lower": {call: func(value string, args []string) ([]string, error) {
+		return []string{strings.ToLower(value)}, nil
+	}},
+	"upper": {call: func(value string, args []string) ([]string, error) {
+		return []string{strings.ToUpper(value)}, nil
+	}},
+	"replace": {args: 2, call: func(value string, args []string) ([]string, error) {
+		return []string{strings.ReplaceAll(value, args[0], args[1])}, nil
+	}},
+	"trunc": {args: 1, check: checkLength, call: func(value string, args []string) ([]string, error) {
+		if err := checkLength(args[0]); err != nil {
+			return nil, err
+		}
+		n, _ := strconv.Atoi(args[0])
+		if runes := []rune(value); len(runes) > n {
+			value = string(runes[:n])
+		}
+		return []string{value}, nil
+	}},
+	"regex": {args: 1, check: checkRegex, call: func(value string, args []string) ([]string, error) {
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		match := re.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			return []string{""}, nil
+		case len(match) > 1:
+			return []string{match[1]}, nil
+		}
+		return []string{match[0]}, nil
+	}},
+	"default": {args: 1, call: func(value string, args []string) ([]string, error) {
+		if value == "" {
+			return []string{args[0]}, nil
+		}
+		return []string{value}, nil
+	}},
+	"sanitize": {call: func(value string, args []string) ([]string, error) {
+		value = strings.TrimLeft(sanitizePattern.ReplaceAllString(value, "-"), ".-")
+		if len(value) > 128 {
+			value = value[:128]
+		}
+		return []string{value}, nil
+	}},
+	"semver": {args: 1, call: func(value string, args []string) ([]string, error) {
+		v, err := FormatVersion(value, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}},
+	"expand": {optional: 1, check: checkDepth, call: func(value string, args []string) ([]string, error) {
+		depth := "major"
+		if len(args) > 0 {
+			depth = args[0]
+		}
+		if err := checkDepth(depth); err != nil {
+			return nil, err
+		}
+		return ExpandVersion(value, versionDepths[depth]), nil
+	}},
+}
+
+func checkLength(arg string) error {
+	if n, err := strconv.Atoi(arg); err != nil || n < 0 {
+		return fmt.Errorf("length %q is not a number", arg)
+	}
+	return nil
+}
+
+func checkDepth(arg string) error {
+	if _, ok := versionDepths[arg]; !ok {
+		return fmt.Errorf("unknown version depth %q, expected major, minor or patch", arg)
+	}
+	return nil
+}
+
+func checkRegex(arg string) error {
+	_, err := regexp.Compile(arg)
+	return err
+}
+
+// FormatVersion formats the core of the version like "1.2.3-rc.1" or "v1.2" with words
+// major, minor and patch of the format.
+func FormatVersion(version, format string) (string, error) {
+	v, ok := ParseVersion(version)
+	if !ok {
+		return "", fmt.Errorf("%q is not a version", version)
+	}
+	parts := v.Core
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	return strings.NewReplacer("major", parts[0], "minor", parts[1], "patch", parts[2]).Replace(format), nil
+}
+
+type maskArg struct {
+	pos     int
+	isField bool
+	value   string
+}
+
+type maskCall struct {
+	pos  int
+	name string
+	args []maskArg
+}
+
+// maskNode is a text or an action (a pipeline of calls, the first one may be "").
+type maskNode struct {
+	text     string
+	pipeline []maskCall
+}
+
+type maskExpr struct {
+	mask  string
+	nodes []maskNode
+}
+
+// CheckMask returns syntax errors of the mask.
+func CheckMask(mask string) error {
+	if !strings.Contains(mask, "{{") {
+		return checkLegacyMask(mask)
+	}
+	_, err := parseMaskExpr(mask)
+	return err
+}
+
+// checkLegacyMask checks depths of @fact:depth in a mask split by "|".
+func checkLegacyMask(mask string) error {
+	pos := 0
+	for _, ttt := range strings.Split(mask, "|") {
+		if i := strings.Index(ttt, ":"); strings.HasPrefix(ttt, "@") && i >= 0 {
+			if err := checkDepth(ttt[i+1:]); err != nil {
+				return &MaskError{Mask: mask, Pos: pos + i + 1, Message: err.Error()}
+			}
+		}
+		pos += len(ttt) + 1
+	}
+	return nil
+}
+
+func parseMaskExpr(mask string) (*maskExpr, error) {
+	expr := &maskExpr{mask: mask}
+	pos := 0
+	for pos < len(mask) {
+		start := strings.Index(mask[pos:], "{{")
+		if start < 0 {
+			expr.nodes = append(expr.nodes, maskNode{text: mask[pos:]})
+			break
+		}
+		if start > 0 {
+			expr.nodes = append(expr.nodes, maskNode{text: mask[pos : pos+start]})
+		}
+		p := &maskParser{expr: expr, pos: pos + start + 2}
+		pipeline, err := p.pipeline()
+		if err != nil {
+			return nil, err
+		}
+		expr.nodes = append(expr.nodes, maskNode{pipeline: pipeline})
+		pos = p.pos
+	}
+	return expr, nil
+}
+
+type maskParser struct {
+	expr *maskExpr
+	pos  int
+}
+
+func (p *maskParser) fail(pos int, format string, a ...any) error {
+	return &MaskError{Mask: p.expr.mask, Pos: pos, Message: fmt.Sprintf(format, a...)}
+}
+
+func (p *maskParser) skipSpaces() {
+	for p.pos < len(p.expr.mask) && p.expr.mask[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// pipeline parses calls up to "}}".
+func (p *maskParser) pipeline() ([]maskCall, error) {
+	calls := make([]maskCall, 0)
+	for {
+		p.skipSpaces()
+		call, err := p.call(len(calls) == 0)
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+		p.skipSpaces()
+		mask := p.expr.mask
+		switch {
+		case strings.HasPrefix(mask[p.pos:], "}}"):
+			p.pos += 2
+			return calls, nil
+		case p.pos < len(mask) && mask[p.pos] == '|':
+			p.pos++
+		case p.pos >= len(mask):
+			return nil, p.fail(p.pos, "unclosed action, expected }}")
+		default:
+			return nil, p.fail(p.pos, "unexpected %q, expected | or }}", mask[p.pos:p.pos+1])
+		}
+	}
+}
+
+// call parses a function with its arguments, the first call of a pipeline may be an operand.
+func (p *maskParser) call(isFirst bool) (maskCall, error) {
+	pos := p.pos
+	name := p.ident()
+	if name == "" {
+		if !isFirst {
+			return maskCall{}, p.fail(pos, "expected a filter")
+		}
+		arg, err := p.operand()
+		if err != nil {
+			return maskCall{}, err
+		}
+		return maskCall{pos: pos, args: []maskArg{arg}}, nil
+	}
+	fn, ok := maskFuncs[name]
+	if !ok {
+		return maskCall{}, p.fail(pos, "unknown function %q", name)
+	}
+	call := maskCall{pos: pos, name: name}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.expr.mask) || strings.HasPrefix(p.expr.mask[p.pos:], "}}") || p.expr.mask[p.pos] == '|' {
+			break
+		}
+		arg, err := p.operand()
+		if err != nil {
+			return maskCall{}, err
+		}
+		call.args = append(call.args, arg)
+	}
+	skip := 0
+	if isFirst {
+		skip = 1
+	}
+	want := fn.args + skip
+	switch {
+	case fn.optional > 0 && (len(call.args) < want || len(call.args) > want+fn.optional):
+		return maskCall{}, p.fail(pos, "%s needs %d to %d arguments, got %d", name, want, want+fn.optional,
+			len(call.args))
+	case fn.optional == 0 && len(call.args) != want:
+		return maskCall{}, p.fail(pos, "%s needs %d arguments, got %d", name, want, len(call.args))
+	}
+	if fn.check != nil {
+		for _, arg := range call.args[skip:] {
+			if arg.isField {
+				continue
+			}
+			if err := fn.check(arg.value); err != nil {
+				return maskCall{}, p.fail(arg.pos, "%s: %v", name, err)
+			}
+		}
+	}
+	return call, nil
+}
+
+func (p *maskParser) ident() string {
+	mask := p.expr.mask
+	end := p.pos
+	for end < len(mask) && (mask[end] == '_' || unicode.IsLetter(rune(mask[end])) ||
+		(end > p.pos && unicode.IsDigit(rune(mask[end])))) {
+		end++
+	}
+	name := mask[p.pos:end]
+	p.pos = end
+	return name
+}
+
+// operand parses a .fact (names may have '-'), a quoted string or a number.
+func (p *maskParser) operand() (maskArg, error) {
+	mask := p.expr.mask
+	pos := p.pos
+	if pos >= len(mask) {
+		return maskArg{}, p.fail(pos, "unclosed action, expected }}")
+	}
+	switch c := mask[pos]; {
+	case c == '.':
+		end := pos + 1
+		for end < len(mask) && isFactChar(mask[end]) {
+			end++
+		}
+		if end == pos+1 {
+			return maskArg{}, p.fail(pos, "expected a fact name after .")
+		}
+		p.pos = end
+		return maskArg{pos: pos, isField: true, value: mask[pos+1 : end]}, nil
+	case c == '"':
+		end := pos + 1
+		for end < len(mask) && mask[end] != '"' {
+			if mask[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(mask) {
+			return maskArg{}, p.fail(pos, "unterminated string")
+		}
+		value, err := strconv.Unquote(mask[pos : end+1])
+		if err != nil {
+			return maskArg{}, p.fail(pos, "bad string: %v", err)
+		}
+		p.pos = end + 1
+		return maskArg{pos: pos, value: value}, nil
+	case c >= '0' && c <= '9':
+		end := pos
+		for end < len(mask) && mask[end] >= '0' && mask[end] <= '9' {
+			end++
+		}
+		p.pos = end
+		return maskArg{pos: pos, value: mask[pos:end]}, nil
+	}
+	return maskArg{}, p.fail(pos, "unexpected %q, expected .fact, \"string\" or number", mask[pos:pos+1])
+}
+
+func isFactChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// tokens evaluates actions, a fact missing in facts is "" (see default), a fact
+// name with '_' may refer to a fact with '-' (.os_name is os-name).
+func (e *maskExpr) tokens(facts map[string]string) ([]Token, error) {
+	tokens := make([]Token, 0, len(e.nodes))
+	for _, node := range e.nodes {
+		if node.pipeline == nil {
+			tokens = append(tokens, Token{Value: []string{node.text}})
+			continue
+		}
+		var values []string
+		for i, call := range node.pipeline {
+			args := make([]string, 0, len(call.args))
+			for _, arg := range call.args {
+				args = append(args, arg.eval(facts))
+			}
+			if call.name == "" {
+				values = args
+				continue
+			}
+			if i == 0 {
+				values, args = args[:1], args[1:]
+			}
+			next := make([]string, 0, len(values))
+			for _, value := range values {
+				result, err := maskFuncs[call.name].call(value, args)
+				if err != nil {
+					return nil, fmt.Errorf("mask %q: col %d: %s: %w", e.mask, call.pos+1, call.name, err)
+				}
+				next = appendUnique(next, result...)
+			}
+			values = next
+		}
+		tokens = append(tokens, Token{Value: values})
+	}
+	return tokens, nil
+}
+
+func (a maskArg) eval(facts map[string]string) string {
+	if !a.isField {
+		return a.value
+	}
+	if value, ok := facts[a.value]; ok {
+		return value
+	}
+	return facts[strings.ReplaceAll(a.value, "_", "-")]
+}
+
+func appendUnique(values []string, more ...string) []string {
+	for _, value := range more {
+		isFound := false
+		for _, v := range values {
+			if v == value {
+				isFound = true
+				break
+			}
+		}
+		if !isFound {
+			values = append(values, value)
+		}
+	}
+	return values
+}
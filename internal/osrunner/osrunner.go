@@ -1,25 +1,146 @@
 package osrunner
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os/exec"
+	"strings"
+	"time"
 )
 
-func Command(args ...string) *exec.Cmd {
-	return exec.Command(args[0], args[1:]...)
+// WaitDelay limits waiting for pipes of a killed command.
+const WaitDelay = 5 * time.Second
+
+// StderrTailSize is how many last bytes of stderr are kept for every stage.
+const StderrTailSize = 4 * 1024
+
+type StageResult struct {
+	Args     []string      `json:"args"`
+	ExitCode int           `json:"exit_code"`
+	Stderr   string        `json:"stderr,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Result struct {
+	Stages []StageResult `json:"stages"`
+	Stdout []byte        `json:"-"`
+}
+
+// Error is returned when one of the stages failed, Stage is the index of the first failed stage.
+type Error struct {
+	Result Result
+	Stage  int
+	Err    error
+}
+
+// errorCommandSize limits the command shown by Error, arguments may be long (labels, scripts).
+const errorCommandSize = 120
+
+func (e *Error) Error() string {
+	command := strings.Join(e.Result.Stages[e.Stage].Args, " ")
+	if len(command) > errorCommandSize {
+		command = command[:errorCommandSize] + "..."
+	}
+	return command + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func Command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = WaitDelay
+	return cmd
 }
 
-func StartAndWait(cmds []*exec.Cmd, cmdOut io.ReadCloser) ([]byte, error) {
-	for _, c := range cmds {
+// WithTimeout is context.WithTimeout where zero timeout means no limit.
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// StartAndWait runs the pipeline and waits for all its stages. Stderr of stages
+// which isn't piped anywhere is captured into the result.
+func StartAndWait(ctx context.Context, cmds []*exec.Cmd, cmdOut io.ReadCloser) (Result, error) {
+	result := Result{Stages: make([]StageResult, len(cmds))}
+	stderrs := make([]*tailBuffer, len(cmds))
+	started := make([]time.Time, len(cmds))
+	for i, c := range cmds {
+		result.Stages[i].Args = c.Args
+		if c.Stderr == nil {
+			stderrs[i] = &tailBuffer{limit: StderrTailSize}
+			c.Stderr = stderrs[i]
+		}
+		started[i] = time.Now()
 		if err := c.Start(); err != nil {
-			return nil, err
+			// stages started before are killed, otherwise they leak writing to a pipe nobody reads
+			for j := range cmds[:i] {
+				_ = cmds[j].Process.Kill()
+				_ = wait(cmds[j], &result.Stages[j], stderrs[j], started[j])
+			}
+			result.Stages[i].ExitCode = -1
+			return result, &Error{Result: result, Stage: i, Err: err}
 		}
 	}
-	res, _ := io.ReadAll(cmdOut)
-	for _, c := range cmds {
-		if err := c.Wait(); err != nil {
-			return nil, err
+	if cmdOut != nil {
+		result.Stdout, _ = io.ReadAll(cmdOut)
+	}
+	failed := -1
+	var failedErr error
+	for i, c := range cmds {
+		err := wait(c, &result.Stages[i], stderrs[i], started[i])
+		if err != nil && failed < 0 {
+			failed, failedErr = i, err
+		}
+	}
+	if ctx.Err() != nil {
+		if failed < 0 {
+			failed = len(cmds) - 1
 		}
+		return result, &Error{Result: result, Stage: failed, Err: ctx.Err()}
 	}
-	return res, nil
+	if failed >= 0 {
+		return result, &Error{Result: result, Stage: failed, Err: failedErr}
+	}
+	return result, nil
+}
+
+func wait(c *exec.Cmd, stage *StageResult, stderr *tailBuffer, started time.Time) error {
+	err := c.Wait()
+	stage.Duration = time.Since(started)
+	stage.ExitCode = c.ProcessState.ExitCode()
+	if stderr != nil {
+		stage.Stderr = strings.TrimSpace(stderr.String())
+	}
+	return err
+}
+
+// StageResults returns results of all stages if err was returned by StartAndWait.
+func StageResults(err error) []StageResult {
+	var runErr *Error
+	if errors.As(err, &runErr) {
+		return runErr.Result.Stages
+	}
+	return nil
+}
+
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
 }
@@ -1,23 +1,183 @@
 package osrunner
 
 import (
+	"context"
+	"errors"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestCommand(t *testing.T) {
 	assertions := require.New(t)
-	assertions.Equal("a b c", strings.Join(Command("a", "b", "c").Args, " "))
+	assertions.Equal("a b c", strings.Join(Command(context.Background(), "a", "b", "c").Args, " "))
 }
 
 func TestStartAndWait(t *testing.T) {
 	assertions := require.New(t)
-	cmd := exec.Command("uname")
+	ctx := context.Background()
+	cmd := Command(ctx, "uname")
 	out, _ := cmd.StdoutPipe()
-	res, err := StartAndWait([]*exec.Cmd{cmd}, out)
+	res, err := StartAndWait(ctx, []*exec.Cmd{cmd}, out)
 	assertions.NoError(err)
-	assertions.Equal("Linux", strings.TrimSpace(string(res)))
+	assertions.Equal("Linux", strings.TrimSpace(string(res.Stdout)))
+	assertions.Len(res.Stages, 1)
+	assertions.Equal([]string{"uname"}, res.Stages[0].Args)
+}
+
+func TestStartAndWaitTimeout(t *testing.T) {
+	assertions := require.New(t)
+	ctx, cancel := WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cmd := Command(ctx, "sleep", "5")
+	out, _ := cmd.StdoutPipe()
+	started := time.Now()
+	_, err := StartAndWait(ctx, []*exec.Cmd{cmd}, out)
+	assertions.True(errors.Is(err, context.DeadlineExceeded), err)
+	assertions.Less(time.Since(started), 4*time.Second)
+}
+
+func TestWithTimeout(t *testing.T) {
+	assertions := require.New(t)
+	ctx, cancel := WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assertions.False(ok)
+}
+
+func TestStartAndWaitError(t *testing.T) {
+	assertions := require.New(t)
+	ctx := context.Background()
+	cmd1 := Command(ctx, "sh", "-c", "echo a; echo oops >&2; exit 3")
+	cmd2 := Command(ctx, "cat")
+	cmd2.Stdin, _ = cmd1.StdoutPipe()
+	out, _ := cmd2.StdoutPipe()
+	res, err := StartAndWait(ctx, []*exec.Cmd{cmd1, cmd2}, out)
+	assertions.Error(err)
+	assertions.Equal("sh -c echo a; echo oops >&2; exit 3: exit status 3", err.Error())
+	assertions.Equal("a\n", string(res.Stdout))
+	stages := StageResults(err)
+	assertions.Len(stages, 2)
+	assertions.Equal(3, stages[0].ExitCode)
+	assertions.Equal("oops", stages[0].Stderr)
+	assertions.Equal(0, stages[1].ExitCode)
+	assertions.Empty(stages[1].Stderr)
+	assertions.Nil(StageResults(errors.New("a")))
+
+	long := &Error{Result: Result{Stages: []StageResult{{Args: []string{"echo", strings.Repeat("a", 1000)}}}},
+		Err: errors.New("failed")}
+	assertions.Equal("echo "+strings.Repeat("a", errorCommandSize-5)+"...: failed", long.Error())
+}
+
+func TestStartAndWaitStartError(t *testing.T) {
+	assertions := require.New(t)
+	ctx := context.Background()
+	cmd1 := Command(ctx, "sleep", "5")
+	cmd2 := Command(ctx, filepath.Join(t.TempDir(), "missing"))
+	cmd2.Stdin, _ = cmd1.StdoutPipe()
+	out, _ := cmd2.StdoutPipe()
+	started := time.Now()
+	res, err := StartAndWait(ctx, []*exec.Cmd{cmd1, cmd2}, out)
+	assertions.Error(err)
+	assertions.Less(time.Since(started), 4*time.Second)
+	assertions.NotNil(cmd1.ProcessState)
+	assertions.Equal(-1, res.Stages[0].ExitCode)
+	assertions.Equal(-1, res.Stages[1].ExitCode)
+	var runErr *Error
+	assertions.ErrorAs(err, &runErr)
+	assertions.Equal(1, runErr.Stage)
+}
+
+func TestTailBuffer(t *testing.T) {
+	assertions := require.New(t)
+	buf := &tailBuffer{limit: 3}
+	n, err := buf.Write([]byte("abcd"))
+	assertions.NoError(err)
+	assertions.Equal(4, n)
+	_, _ = buf.Write([]byte("e"))
+	assertions.Equal("cde", buf.String())
+}
+
+func TestExecRunner(t *testing.T) {
+	variants := []struct {
+		pipeline Pipeline
+		result   string
+	}{
+		{pipeline: NewPipeline("echo", "a"), result: "a"},
+		{
+			pipeline: Pipeline{Stages: []Stage{{Args: []string{"echo", "a b"}}, {Args: []string{"wc", "-w"}, Pipe: "|"}}},
+			result:   "2",
+		},
+		{
+			pipeline: Pipeline{Stages: []Stage{{Args: []string{"sh", "-c", "echo a >&2"}}, {Args: []string{"cat"}, Pipe: "|&"}}},
+			result:   "a",
+		},
+		{pipeline: Pipeline{Dir: "/", Stages: []Stage{{Args: []string{"pwd"}}}}, result: "/"},
+	}
+	assertions := require.New(t)
+	for n, variant := range variants {
+		res, err := ExecRunner{}.Run(context.Background(), variant.pipeline)
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, strings.TrimSpace(string(res.Stdout)), n)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	assertions := require.New(t)
+	ctx := context.Background()
+	recorder := NewRecorder(ExecRunner{})
+	_, err := recorder.Run(ctx, NewPipeline("echo", "a"))
+	assertions.NoError(err)
+	_, err = recorder.Run(ctx, NewPipeline("sh", "-c", "exit 2"))
+	assertions.Error(err)
+	fileName := filepath.Join(t.TempDir(), "records.json")
+	assertions.NoError(recorder.Save(fileName))
+
+	replayer, err := LoadReplayer(fileName)
+	assertions.NoError(err)
+	assertions.Len(replayer.Unused(), 2)
+	_, err = replayer.Run(ctx, NewPipeline("echo", "b"))
+	assertions.Error(err)
+	res, err := replayer.Run(ctx, NewPipeline("sh", "-c", "exit 2"))
+	assertions.Equal("sh -c exit 2: exit status 2", err.Error())
+	assertions.Equal(2, res.Stages[0].ExitCode)
+	res, err = replayer.Run(ctx, Pipeline{Dir: "/tmp", Stages: []Stage{{Args: []string{"echo", "a"}}}})
+	assertions.NoError(err)
+	assertions.Equal("a\n", string(res.Stdout))
+	assertions.Empty(replayer.Unused())
+	_, err = replayer.Run(ctx, NewPipeline("echo", "a"))
+	assertions.Error(err)
+
+	_, err = LoadReplayer(filepath.Join(t.TempDir(), "absent.json"))
+	assertions.Error(err)
+}
+
+func TestReplayTimeout(t *testing.T) {
+	assertions := require.New(t)
+	replayer := NewReplayer([]Record{{Pipeline: NewPipeline("sleep", "5"), Error: "context deadline exceeded"}})
+	_, err := replayer.Run(context.Background(), NewPipeline("sleep", "5"))
+	assertions.True(errors.Is(err, context.DeadlineExceeded), err)
+}
+
+func TestPipelineKey(t *testing.T) {
+	variants := []struct {
+		pipeline Pipeline
+		result   string
+	}{
+		{pipeline: NewPipeline("a", "b c"), result: `a "b c"`},
+		{pipeline: NewPipeline("docker", "run", "--name", "x1", "a"), result: "docker run --name * a"},
+		{pipeline: NewPipeline("docker", "rm", "-f", "x1"), result: "docker rm -f *"},
+		{
+			pipeline: Pipeline{Stages: []Stage{{Args: []string{"a"}}, {Args: []string{"b"}, Pipe: "|&"}, {Args: []string{"c"}}}},
+			result:   "a |& b | c",
+		},
+	}
+	assertions := require.New(t)
+	for n, variant := range variants {
+		assertions.Equal(variant.result, pipelineKey(variant.pipeline), n)
+	}
 }
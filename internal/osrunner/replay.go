@@ -0,0 +1,178 @@
+package osrunner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Record is a pipeline run captured by Recorder and served back by Replayer.
+type Record struct {
+	Pipeline    Pipeline      `json:"pipeline"`
+	Stdout      string        `json:"stdout"`
+	Stages      []StageResult `json:"results,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	FailedStage int           `json:"failed_stage,omitempty"`
+}
+
+// Recorder runs pipelines with Runner and remembers their results.
+type Recorder struct {
+	Runner  Runner
+	mu      sync.Mutex
+	records []Record
+}
+
+func NewRecorder(runner Runner) *Recorder {
+	return &Recorder{Runner: runner}
+}
+
+func (r *Recorder) Run(ctx context.Context, pipeline Pipeline) (Result, error) {
+	result, err := r.Runner.Run(ctx, pipeline)
+	record := Record{Pipeline: pipeline, Stdout: string(result.Stdout), Stages: result.Stages}
+	if err != nil {
+		record.Error = err.Error()
+		var runErr *Error
+		if errors.As(err, &runErr) {
+			record.Error = runErr.Err.Error()
+			record.FailedStage = runErr.Stage
+		}
+	}
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+	return result, err
+}
+
+func (r *Recorder) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Record{}, r.records...)
+}
+
+func (r *Recorder) Save(fileName string) error {
+	data, err := json.MarshalIndent(r.Records(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0600)
+}
+
+// Replayer serves recorded results, every record is used once in the recorded order.
+// Pipelines are matched by args and pipes, the directory and container names
+// (values of --name and arguments of rm -f) are ignored.
+type Replayer struct {
+	mu      sync.Mutex
+	records []Record
+	used    []bool
+}
+
+func NewReplayer(records []Record) *Replayer {
+	return &Replayer{records: records, used: make([]bool, len(records))}
+}
+
+func LoadReplayer(fileName string) (*Replayer, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return NewReplayer(records), nil
+}
+
+func (r *Replayer) Run(ctx context.Context, pipeline Pipeline) (Result, error) {
+	if ctx.Err() != nil {
+		return Result{}, ctx.Err()
+	}
+	key := pipelineKey(pipeline)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, record := range r.records {
+		if r.used[i] || pipelineKey(record.Pipeline) != key {
+			continue
+		}
+		r.used[i] = true
+		return replayRecord(pipeline, record)
+	}
+	return Result{}, fmt.Errorf("no recorded run of %q", key)
+}
+
+// Unused returns records which weren't replayed.
+func (r *Replayer) Unused() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unused := make([]Record, 0)
+	for i, record := range r.records {
+		if !r.used[i] {
+			unused = append(unused, record)
+		}
+	}
+	return unused
+}
+
+func replayRecord(pipeline Pipeline, record Record) (Result, error) {
+	result := Result{Stdout: []byte(record.Stdout), Stages: record.Stages}
+	if len(result.Stages) == 0 {
+		for _, stage := range pipeline.Stages {
+			result.Stages = append(result.Stages, StageResult{Args: stage.Args})
+		}
+	}
+	if record.Error == "" {
+		return result, nil
+	}
+	err := errors.New(record.Error)
+	switch record.Error {
+	case context.DeadlineExceeded.Error():
+		err = context.DeadlineExceeded
+	case context.Canceled.Error():
+		err = context.Canceled
+	}
+	stage := record.FailedStage
+	if stage >= len(result.Stages) {
+		stage = len(result.Stages) - 1
+	}
+	return result, &Error{Result: result, Stage: stage, Err: err}
+}
+
+func pipelineKey(pipeline Pipeline) string {
+	stages := make([]string, 0, len(pipeline.Stages))
+	for i, stage := range pipeline.Stages {
+		args := make([]string, 0, len(stage.Args))
+		for j, arg := range stage.Args {
+			if isContainerName(stage.Args, j) {
+				arg = "*"
+			}
+			args = append(args, quoteArg(arg))
+		}
+		s := strings.Join(args, " ")
+		if i > 0 {
+			pipe := stage.Pipe
+			if pipe == "" {
+				pipe = "|"
+			}
+			s = pipe + " " + s
+		}
+		stages = append(stages, s)
+	}
+	return strings.Join(stages, " ")
+}
+
+func isContainerName(args []string, i int) bool {
+	if i > 0 && args[i-1] == "--name" {
+		return true
+	}
+	return i > 2 && args[1] == "rm" && args[2] == "-f"
+}
+
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\n\"'|&") {
+		return fmt.Sprintf("%q", arg)
+	}
+	return arg
+}
@@ -0,0 +1,48 @@
+package osrunner
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Stage is one command of a pipeline, Pipe tells which output of the previous
+// stage is its stdin: "|" for stdout and "|&" for stderr.
+type Stage struct {
+	Args []string `json:"args"`
+	Pipe string   `json:"pipe,omitempty"`
+}
+
+type Pipeline struct {
+	Dir    string  `json:"dir,omitempty"`
+	Stages []Stage `json:"stages"`
+}
+
+type Runner interface {
+	Run(ctx context.Context, pipeline Pipeline) (Result, error)
+}
+
+// NewPipeline returns a pipeline of the single command.
+func NewPipeline(args ...string) Pipeline {
+	return Pipeline{Stages: []Stage{{Args: args}}}
+}
+
+// ExecRunner runs pipelines as os processes.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, pipeline Pipeline) (Result, error) {
+	cmds := make([]*exec.Cmd, 0, len(pipeline.Stages))
+	for i, stage := range pipeline.Stages {
+		cmd := Command(ctx, stage.Args...)
+		cmd.Dir = pipeline.Dir
+		if i > 0 {
+			if stage.Pipe == "|&" {
+				cmd.Stdin, _ = cmds[i-1].StderrPipe()
+			} else {
+				cmd.Stdin, _ = cmds[i-1].StdoutPipe()
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	cmdOut, _ := cmds[len(cmds)-1].StdoutPipe()
+	return StartAndWait(ctx, cmds, cmdOut)
+}
@@ -1,58 +1,116 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abatalev/smartdockerbuild/internal/cache"
+	"github.com/abatalev/smartdockerbuild/internal/facts"
+	"github.com/abatalev/smartdockerbuild/internal/hash"
 	"github.com/abatalev/smartdockerbuild/internal/logic"
 	"github.com/abatalev/smartdockerbuild/internal/osrunner"
 	"gopkg.in/yaml.v3"
 )
 
-//go:generate go-bindata -prefix "facts/" -pkg main -o bindata.go facts/...
-
 type Def struct {
-	Name    string   `yaml:"name"`
-	CmdName string   `yaml:"cmd"`
-	Args    []string `yaml:"args"`
-}
-
-type DefInternal struct {
-	Name string   `yaml:"name"`
-	Args []string `yaml:"args"`
-}
-
-type Defs struct {
-	Facts []DefInternal `yaml:"facts"`
+	Name    string        `yaml:"name"`
+	CmdName string        `yaml:"cmd"`
+	Args    []string      `yaml:"args"`
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 type Config struct {
-	Name     string   `yaml:"name"`
-	Prefixes []string `yaml:"prefixes"`
-	Facts    []Def    `yaml:"facts"`
-	Tags     []string `yaml:"tags"`
+	Name           string            `yaml:"name"`
+	Target         string            `yaml:"target"`
+	Platform       string            `yaml:"platform"`
+	BuildArgs      map[string]string `yaml:"build_args"`
+	Hash           logic.HashFormat  `yaml:"hash"`
+	HashInputs     logic.HashInputs  `yaml:"hash_inputs"`
+	HashExclude    []string          `yaml:"hash_exclude"`
+	MissingSources string            `yaml:"missing_sources"`
+	Prefixes       []string          `yaml:"prefixes"`
+	Facts          []Def             `yaml:"facts"`
+	Tags           []string          `yaml:"tags"`
+	FactTimeout    time.Duration     `yaml:"fact_timeout"`
 }
 
 var gitHash = "development"
 var p2hHash = ""
 
+const (
+	exitTimeout     = 124
+	exitInterrupted = 130
+)
+
+var factContainerCounter int64
+
 type Options struct {
-	isVersion      bool
-	isHelp         bool
-	isForce        bool
-	isPush         bool
-	DockerfileName string
+	Command       string
+	Since         string
+	isBuild       bool
+	isExplain     bool
+	isNoLabel     bool
+	DiffWith      string
+	isVersion     bool
+	isHelp        bool
+	isForce       bool
+	isPush        bool
+	isDryRun      bool
+	isListFacts   bool
+	isKeepGoing   bool
+	isNoHashCache bool
+	Jobs          int
+	FactsDirs     []string
+	Timeout       time.Duration
+	BuildTimeout  time.Duration
+	RecordFile    string
+	ReplayFile    string
+	Output        string
+	Dockerfiles   []string
+}
+
+// Operation is a docker command changing images, Kind is build, tag or push.
+type Operation struct {
+	Kind string
+	Mask string
+	Tag  string
+	Args []string
+}
+
+// Builder holds dependencies of a run, Runner executes every external command
+// and the progress is printed to Out (stdout by default).
+type Builder struct {
+	Runner   osrunner.Runner
+	Registry *facts.Registry
+	Options  Options
+	Out      io.Writer
+	images   *imageList
+	selected map[string]bool
+}
+
+// imageList is "docker image list" shared by all images of a run.
+type imageList struct {
+	once   sync.Once
+	stdout string
+	err    error
 }
 
 func main() {
-	fmt.Println("smart docker build")
 	args := os.Args[1:]
 
 	options, err := parseOptions(args)
@@ -60,6 +118,12 @@ func main() {
 		panic(err)
 	}
 
+	var out io.Writer = os.Stdout
+	if options.Output == "json" || options.Command == "hash" || (options.Command == "affected" && !options.isBuild) {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, "smart docker build")
+
 	if options.isVersion {
 		fmt.Println("Version:")
 		fmt.Println("     git", gitHash)
@@ -71,36 +135,297 @@ func main() {
 
 	if options.isHelp {
 		fmt.Println()
-		flag.PrintDefaults()
+		printCommands(os.Stdout)
+		fmt.Println()
+		fmt.Println("Flags:")
+		flags := newFlagSet(&Options{})
+		flags.SetOutput(os.Stdout)
+		flags.PrintDefaults()
 		fmt.Println()
 		return
 	}
 
-	os.Exit(BuildDockerImage(".", options.DockerfileName, options.isForce, options.isPush))
+	registry, err := loadFacts(out, ".", options.FactsDirs)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if options.isListFacts {
+		printFacts(registry)
+		return
+	}
+
+	runner, recorder, err := newRunner(options)
+	if err != nil {
+		fmt.Fprintln(out, " -> runner:", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	builder := Builder{Runner: runner, Registry: registry, Options: options, Out: out}
+	hashCacheFile := openHashCache(out, options)
+	exit := func(code int) {
+		saveHashCache(out, hashCacheFile)
+		os.Exit(code)
+	}
+	var summary Summary
+	switch options.Command {
+	case "hash":
+		exit(builder.PrintHashTags(ctx, os.Stdout, "."))
+	case "clean":
+		exit(builder.Clean("."))
+	case "diff":
+		exit(builder.DiffManifests(ctx, os.Stdout, "."))
+	case "affected":
+		summary = builder.RunAffected(ctx, ".")
+	default:
+		summary = builder.BuildAll(ctx, ".")
+	}
+	stop()
+	if recorder != nil {
+		if err := recorder.Save(options.RecordFile); err != nil {
+			fmt.Fprintln(out, " -> record:", err)
+		}
+	}
+	if options.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			fmt.Fprintln(out, " -> output:", err)
+		}
+	}
+	exit(summary.ExitCode)
+}
+
+// openHashCache sets hash.HashCache unless -no-hash-cache is given and returns its file.
+func openHashCache(out io.Writer, options Options) string {
+	if options.isNoHashCache || options.Command == "clean" {
+		return ""
+	}
+	file, err := cache.HashesFile()
+	if err != nil {
+		fmt.Fprintln(out, " -> hash cache: warning!", err)
+		return ""
+	}
+	hashCache, err := hash.LoadFileCache(file)
+	if err != nil {
+		fmt.Fprintln(out, " -> hash cache: warning!", err)
+		hashCache = hash.NewFileCache()
+	}
+	hash.HashCache = hashCache
+	return file
+}
+
+func saveHashCache(out io.Writer, file string) {
+	if file == "" || hash.HashCache == nil {
+		return
+	}
+	if err := hash.HashCache.Save(file); err != nil {
+		fmt.Fprintln(out, " -> hash cache: warning!", err)
+	}
+}
+
+func newRunner(options Options) (osrunner.Runner, *osrunner.Recorder, error) {
+	var runner osrunner.Runner = osrunner.ExecRunner{}
+	if options.ReplayFile != "" {
+		replayer, err := osrunner.LoadReplayer(options.ReplayFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		runner = replayer
+	}
+	if options.RecordFile == "" {
+		return runner, nil, nil
+	}
+	recorder := osrunner.NewRecorder(runner)
+	return recorder, recorder, nil
 }
 
 func parseOptions(args []string) (Options, error) {
 	var options Options
-	flags := flag.NewFlagSet("1", flag.ExitOnError)
+	if len(args) > 0 && isCommand(args[0]) {
+		options.Command = args[0]
+		args = args[1:]
+	}
+	flags := newFlagSet(&options)
+	err := flags.Parse(args)
+	if len(flags.Args()) > 0 {
+		options.Dockerfiles = flags.Args()
+	}
+	switch options.Command {
+	case "plan":
+		options.isDryRun = true
+	case "push":
+		options.isPush = true
+	}
+	return options, err
+}
+
+func newFlagSet(options *Options) *flag.FlagSet {
+	flags := flag.NewFlagSet("sdb", flag.ExitOnError)
+	flags.StringVar(&options.Since, "since", "", "affected: git ref to compare the working tree with")
+	flags.BoolVar(&options.isBuild, "build", false, "affected: build affected images")
+	flags.BoolVar(&options.isNoLabel, "no-manifest-label", false, "Don't put the digest of the hash tag manifest into the sdb.manifest label")
+	flags.BoolVar(&options.isExplain, "explain", false, "hash: show inputs of hash tags")
+	flags.StringVar(&options.DiffWith, "diff", "", "hash: show changes since the manifest file or the manifest label of the image")
 	flags.BoolVar(&options.isVersion, "version", false, "Show version of application")
 	flags.BoolVar(&options.isHelp, "help", false, "Show help")
 	flags.BoolVar(&options.isForce, "force", false, "Ignore cached images")
 	flags.BoolVar(&options.isPush, "push", false, "Push images")
-	err := flags.Parse(args)
-	if len(flags.Args()) > 0 {
-		options.DockerfileName = flags.Args()[0]
+	flags.BoolVar(&options.isDryRun, "dry-run", false, "Show build, tag and push operations without executing them")
+	flags.IntVar(&options.Jobs, "jobs", 1, "Number of images built in parallel")
+	flags.BoolVar(&options.isKeepGoing, "keep-going", false, "Build other images after a failure")
+	flags.BoolVar(&options.isNoHashCache, "no-hash-cache", false, "Hash all input files, don't use digests cached by previous runs")
+	flags.BoolVar(&options.isListFacts, "list-facts", false, "Show known facts and where they come from")
+	flags.DurationVar(&options.Timeout, "timeout", 0, "Timeout of every docker command and fact except build (0 - no limit)")
+	flags.DurationVar(&options.BuildTimeout, "build-timeout", 0, "Timeout of docker build (0 - no limit)")
+	flags.StringVar(&options.RecordFile, "record", "", "Record executed commands and their output to file")
+	flags.StringVar(&options.ReplayFile, "replay", "", "Replay commands recorded by -record instead of executing them")
+	flags.Func("output", "Output format: text or json (the report to stdout, progress to stderr)", func(s string) error {
+		if s != "text" && s != "json" {
+			return fmt.Errorf("unknown output format %q", s)
+		}
+		options.Output = s
+		return nil
+	})
+	flags.Func("facts-dir", "Load fact libraries from directory (can be repeated)", func(dir string) error {
+		options.FactsDirs = append(options.FactsDirs, dir)
+		return nil
+	})
+	return flags
+}
+
+func (b Builder) BuildDockerImage(ctx context.Context, workDir string) int {
+	return b.BuildAll(ctx, workDir).ExitCode
+}
+
+// BuildAll builds every Dockerfile matched by Options.Dockerfiles.
+// The exit code is the first non-zero exit code of the images.
+func (b Builder) BuildAll(ctx context.Context, workDir string) Summary {
+	started := time.Now()
+	summary := Summary{Images: make([]Report, 0)}
+	dockerFiles, err := logic.FindDockerFiles(workDir, b.Options.Dockerfiles)
+	if err == nil && len(dockerFiles) == 0 {
+		err = errors.New("no Dockerfile")
 	}
-	return options, err
+	if err != nil {
+		fmt.Fprintln(b.out(), " -> ", err)
+		summary.Error = err.Error()
+		summary.ExitCode = 1
+		return summary
+	}
+
+	images, err := logic.SortImages(describeImages(workDir, dockerFiles))
+	if err != nil {
+		fmt.Fprintln(b.out(), " -> ", err)
+		summary.Error = err.Error()
+		summary.ExitCode = 1
+		return summary
+	}
+
+	b.images = &imageList{}
+	summary.Images = b.buildImages(ctx, workDir, images)
+	for _, report := range summary.Images {
+		if summary.ExitCode == 0 {
+			summary.ExitCode = report.ExitCode
+		}
+	}
+	if summary.ExitCode == 0 && ctx.Err() != nil {
+		summary.ExitCode = exitCode(ctx.Err())
+	}
+	summary.Seconds = time.Since(started).Seconds()
+	if len(dockerFiles) > 1 {
+		printSummary(b.out(), summary)
+	}
+	return summary
+}
+
+// describeImages finds names of images and their FROM images for SortImages.
+// Problems with a Dockerfile or its config are reported later by Build.
+func describeImages(workDir string, dockerFiles []string) []logic.Image {
+	images := make([]logic.Image, 0, len(dockerFiles))
+	for _, dockerFile := range dockerFiles {
+		image := logic.Image{DockerFile: dockerFile, Name: dockerFile}
+		fullDockerFile := filepath.Join(workDir, dockerFile)
+		if logic.IsDockerFile(fullDockerFile) {
+			image.Name = logic.GetImageName(fullDockerFile)
+			if cfg, err := imageConfig(workDir, dockerFile); err == nil {
+				if cfg.Name != "" {
+					image.Name = cfg.Name
+				}
+				for _, prefix := range cfg.Prefixes {
+					image.References = append(image.References, prefixedName(prefix, image.Name))
+				}
+			}
+		}
+		image.From, _ = logic.GetFromImages(workDir, dockerFile)
+		images = append(images, image)
+	}
+	return images
+}
+
+// failedUpstream returns the name of an upstream image without a hash tag.
+func failedUpstream(image logic.Image, hashTags map[string]string) string {
+	for _, name := range image.Upstream {
+		if _, ok := hashTags[name]; !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func printSummary(out io.Writer, summary Summary) {
+	fmt.Fprintln(out, " -> summary")
+	for _, report := range summary.Images {
+		status := "ok"
+		if report.Build.Decision == "aborted" {
+			status = "not built"
+		}
+		if report.ExitCode != 0 {
+			status = "failed, exit code " + strconv.Itoa(report.ExitCode)
+		}
+		image := report.Image
+		if report.HashTag != "" {
+			image += ":" + report.HashTag
+		}
+		fmt.Fprintln(out, " --> "+report.Dockerfile, image, report.Build.Decision, status)
+	}
+	fmt.Fprintln(out, " --> images:", len(summary.Images), "wall-clock time:",
+		time.Duration(summary.Seconds*float64(time.Second)).Round(time.Millisecond))
 }
 
-func BuildDockerImage(workDir, dockerFile string, isForce, isPush bool) int {
-	fmt.Println(" -> file", dockerFile)
+func (b Builder) out() io.Writer {
+	if b.Out == nil {
+		return os.Stdout
+	}
+	return b.Out
+}
+
+// Build builds, inspects and tags the image of dockerFile.
+// Upstream maps names of local upstream images to their hash tags.
+func (b Builder) Build(ctx context.Context, workDir, dockerFile string, upstream map[string]string) Report {
+	report := Report{Dockerfile: dockerFile}
+	r := reporter{out: b.out(), report: &report}
+	report.ExitCode = b.build(ctx, r, workDir, dockerFile, upstream)
+	return report
+}
+
+func (b Builder) build(ctx context.Context, r reporter, workDir, dockerFile string, upstream map[string]string) int {
+	options := b.Options
+	if !isBuildCommand(options.Command) {
+		b.Options.isForce = false
+	}
+	r.Println(" -> file", dockerFile)
 	fullDockerFile := filepath.Join(workDir, dockerFile)
 	// fmt.Println(" -> workdir", workDir)
 	// fmt.Println(" -> fullName", fullDockerFile)
 	_, err := os.Lstat(fullDockerFile)
+	if err == nil && !logic.IsDockerFile(fullDockerFile) {
+		err = errors.New("unknown Dockerfile name " + dockerFile)
+	}
 	if err != nil {
-		fmt.Println(" -> ", err)
+		r.Println(" -> ", err)
+		r.Fail("stat", err)
 		return 1
 	}
 	dirName := filepath.Dir(fullDockerFile)
@@ -108,6 +433,7 @@ func BuildDockerImage(workDir, dockerFile string, isForce, isPush bool) int {
 
 	cfg, err := loadConfig(filepath.Join(dirName, imageName+".sdb.yaml"))
 	if err != nil {
+		r.Fail("config", err)
 		return 1
 	}
 
@@ -115,77 +441,190 @@ func BuildDockerImage(workDir, dockerFile string, isForce, isPush bool) int {
 	if cfg.Name != "" {
 		hashName = cfg.Name
 	}
-	hashTag := logic.CalcHash(workDir, dockerFile) // TODO fix WorkDir
-	isNeedBuild, err := checkOldBuild(isForce, hashName, hashTag)
+	r.report.Image = hashName
+	hashTag, manifest, err := cfg.hashInputs(workDir, dockerFile, hashName, upstream) // TODO fix WorkDir
 	if err != nil {
+		r.Println(" --> hash:", err)
+		r.Fail("hash", err)
 		return 1
 	}
+	r.report.HashTag = hashTag
+	r.addInputs(manifest)
+	if err := saveManifest(hashName, hashTag, manifest); err != nil {
+		r.Warn(" --->", "warning! "+err.Error())
+	}
+	isNeedBuild, err := b.checkOldBuild(ctx, r, hashName, hashTag)
+	if err != nil {
+		return exitCode(err)
+	}
 
 	hash := hashName + ":" + hashTag
+	r.report.Build.Decision = "skip"
 	if isNeedBuild {
-		if exitCode := dockerBuild(workDir, dockerFile, hash); exitCode != 0 {
+		r.report.Build.Decision = "build"
+	} else if err := b.checkManifestLabel(ctx, hash, manifest); err != nil {
+		r.Warn(" --->", "warning! "+err.Error())
+	}
+	if isNeedBuild && isBuildCommand(options.Command) {
+		if err := cfg.checkSources(r, workDir, dockerFile); err != nil {
+			r.Println(" --> ", err)
+			r.Fail("sources", err)
+			return 1
+		}
+	}
+	if options.isDryRun {
+		r.report.Build.DryRun = true
+		if options.isNoLabel {
+			manifest = nil
+		}
+		return cfg.Plan(r, dockerFile, hashName, hashTag, manifest, isNeedBuild, options.isPush)
+	}
+	if options.Command == "inspect" {
+		return inspect(r, hashName, hashTag, !isNeedBuild)
+	}
+	if isNeedBuild && !isBuildCommand(options.Command) {
+		err := errors.New("image " + hash + " not found, build it first")
+		r.Println(" --> ", err)
+		r.report.Errors = append(r.report.Errors, ErrorReport{Operation: options.Command, Error: err.Error()})
+		return 1
+	}
+	if isNeedBuild {
+		started := time.Now()
+		label := manifest
+		if options.isNoLabel {
+			label = nil
+		}
+		exitCode := b.dockerBuild(ctx, r, cfg, workDir, dockerFile, hash, label)
+		r.report.Build.Seconds = time.Since(started).Seconds()
+		if exitCode != 0 {
 			return exitCode
 		}
 	} else {
-		fmt.Println(" --> (" + hash + ") image exists. build skipped")
+		r.Println(" --> (" + hash + ") image exists. build skipped")
 	}
 
-	fmt.Println(" --> gathering facts")
-	facts := cfg.GatheringFacts(hash)
-	return cfg.DoRules(hashName, hashTag, facts, isPush, cfg.Prefixes)
+	r.Println(" --> gathering facts")
+	factValues, err := cfg.GatheringFacts(ctx, r, b.Runner, hash, b.Registry, options.Timeout)
+	r.report.Facts = factValues
+	if err != nil {
+		r.Println(" -> aborted!")
+		return exitCode(err)
+	}
+	if err := cache.SaveFacts(hashName, hashTag, factValues); err != nil {
+		r.Warn(" --->", "facts cache: warning! "+err.Error())
+	}
+	if options.Command == "facts" {
+		return 0
+	}
+	return cfg.DoRules(ctx, r, b.Runner, options.Timeout, hashName, hashTag, factValues, options.isPush)
 }
 
-func logStrings(name, content string) {
-	for n, s := range strings.Split(content, "\n") {
-		if n == 0 {
-			fmt.Println(" ---> "+name+":", s)
-		} else {
-			fmt.Println("          ->:", s)
+// Plan prints operations of the run without executing them. Facts are taken
+// from the cache of previous runs, unknown facts are shown as <name>.
+func (cfg Config) Plan(r reporter, dockerFile, hashName, hashTag string, manifest hash.Manifest,
+	isNeedBuild, isPush bool) int {
+	hash := hashName + ":" + hashTag
+	operations := make([]Operation, 0)
+	if isNeedBuild {
+		operations = append(operations, Operation{Kind: "build", Args: cfg.dockerBuildArgs(dockerFile, hash, manifest)})
+	} else {
+		r.Println(" --> (" + hash + ") image exists. build skipped")
+	}
+
+	r.Println(" --> cached facts")
+	factValues, err := cache.LoadFacts(hashName, hashTag)
+	if err != nil {
+		factValues = make(map[string]string)
+	}
+	for _, def := range cfg.Facts {
+		if value, ok := factValues[def.Name]; ok {
+			r.Println(" ---> fact:", def.Name, "=", value)
+			continue
 		}
+		r.Warn(" --->", "fact "+def.Name+" unresolved")
+		factValues[def.Name] = "<" + def.Name + ">"
+	}
+	r.report.Facts = factValues
+
+	r.Println(" --> plan")
+	tagOperations, err := cfg.PlanTags(hashName, hashTag, factValues, isPush)
+	if err != nil {
+		r.Warn(" --->", "warning! "+err.Error())
+	}
+	r.addTags(tagOperations)
+	operations = append(operations, tagOperations...)
+	for _, operation := range operations {
+		r.Println(" ---> "+operation.Kind+":", strings.Join(shortArgs(operation.Args), " "))
+		r.report.Operations = append(r.report.Operations, operation.Args)
+	}
+	return 0
+}
+
+func exitCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return exitTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
 	}
+	return 1
 }
 
-func dockerBuild(workDir, dockerFile, hash string) int {
-	fmt.Println(" --> build", hash)
-	cmd := exec.Command("docker", "build", "-t", hash, "-f", dockerFile, ".")
-	cmd.Dir = workDir
-	var stderr, stdout bytes.Buffer
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		logStrings("stderr", strings.TrimSpace(stderr.String()))
-		logStrings("stdout", strings.TrimSpace(stdout.String()))
-		fmt.Println(" ---> error:", err)
-		fmt.Println(" ---> exit code:", cmd.ProcessState.ExitCode())
-		fmt.Println(" -> aborted!")
-		return cmd.ProcessState.ExitCode()
+func (b Builder) dockerBuild(ctx context.Context, r reporter, cfg Config, workDir, dockerFile, hash string,
+	manifest hash.Manifest) int {
+	r.Println(" --> build", hash)
+	ctx, cancel := osrunner.WithTimeout(ctx, b.Options.BuildTimeout)
+	defer cancel()
+	pipeline := osrunner.NewPipeline(cfg.dockerBuildArgs(dockerFile, hash, manifest)...)
+	pipeline.Dir = workDir
+	res, err := b.Runner.Run(ctx, pipeline)
+	if err != nil {
+		for _, stage := range osrunner.StageResults(err) {
+			r.logStrings("stderr", stage.Stderr)
+		}
+		r.logStrings("stdout", strings.TrimSpace(string(res.Stdout)))
+		r.Println(" ---> error:", err)
+		r.Println(" -> aborted!")
+		r.report.Errors = append(r.report.Errors, ErrorReport{Operation: "build", Error: err.Error(), Stages: res.Stages})
+		if ctx.Err() != nil || len(res.Stages) == 0 || res.Stages[0].ExitCode <= 0 {
+			return exitCode(err)
+		}
+		return res.Stages[0].ExitCode
 	}
 	return 0
 }
 
-func checkOldBuild(isForce bool, hashName string, hashTag string) (bool, error) {
-	if isForce {
+func (b Builder) checkOldBuild(ctx context.Context, r reporter, hashName string, hashTag string) (bool, error) {
+	if b.Options.isForce {
 		return true, nil
 	}
 
-	existImage, err := existsImage(hashName, hashTag)
+	images, err := b.listImages(ctx)
 	if err != nil {
-		fmt.Println(" -> aborted. error", err)
+		r.Fail("image list", err)
+		r.Println(" -> aborted. error", err)
 		return false, err
 	}
 
-	return !existImage, nil
+	return !logic.FindImage(images, hashName, hashTag), nil
 }
 
-func loadConfig(configName string) (Config, error) {
-	cfg := Config{}
-	yamlFile, err := os.ReadFile(configName)
-	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
-		return Config{}, err
+// listImages runs "docker image list" once per run.
+func (b Builder) listImages(ctx context.Context) (string, error) {
+	list := b.images
+	if list == nil {
+		list = &imageList{}
 	}
+	list.once.Do(func() {
+		ctx, cancel := osrunner.WithTimeout(ctx, b.Options.Timeout)
+		defer cancel()
+		list.stdout, list.err = logic.ListImages(ctx, b.Runner)
+	})
+	return list.stdout, list.err
+}
 
-	err = yaml.Unmarshal(yamlFile, &cfg)
+func loadConfig(configName string) (Config, error) {
+	cfg, err := readConfig(configName)
 	if err != nil {
 		log.Printf("error: %v", err)
 		return Config{}, err
@@ -193,117 +632,369 @@ func loadConfig(configName string) (Config, error) {
 	return cfg, nil
 }
 
-func existsImage(hashName, hashTag string) (bool, error) {
-	cmd, cmdOut := DockerImageList()
-	res, err := osrunner.StartAndWait([]*exec.Cmd{cmd}, cmdOut)
-	if err != nil {
-		return false, err
+// imageConfig reads <image>.sdb.yaml of the Dockerfile, a missing config is empty.
+func imageConfig(workDir, dockerFile string) (Config, error) {
+	fullDockerFile := filepath.Join(workDir, dockerFile)
+	if !logic.IsDockerFile(fullDockerFile) {
+		return Config{}, errors.New("unknown Dockerfile name " + dockerFile)
+	}
+	imageName := logic.GetImageName(fullDockerFile)
+	cfg, err := readConfig(filepath.Join(filepath.Dir(fullDockerFile), imageName+".sdb.yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil
 	}
-	return logic.FindImage(string(res), hashName, hashTag), nil
+	return cfg, err
 }
 
-func DockerImageList() (*exec.Cmd, io.ReadCloser) {
-	cmd := osrunner.Command("docker", "image", "list")
-	cmdOut, _ := cmd.StdoutPipe()
-	return cmd, cmdOut
+// hashInputs returns the hash tag of the image made by cfg.Hash and its manifest.
+func (cfg Config) hashInputs(workDir, dockerFile, hashName string, upstream map[string]string) (string,
+	hash.Manifest, error) {
+	inputs := cfg.HashInputs
+	inputs.Exclude = cfg.HashExclude
+	manifest, err := logic.CalcManifest(workDir, dockerFile, upstream, inputs)
+	if err != nil {
+		return "", nil, err
+	}
+	manifest = append(manifest, cfg.hashEntries()...)
+	hashTag, err := cfg.Hash.HashTag(manifest, hashName, cfg.Target)
+	if err != nil {
+		return "", nil, err
+	}
+	return hashTag, manifest, nil
 }
 
-func RunCmdChain(useEntryPoint bool, hash string, args []string) (string, error) {
-	cmds, cmdOut := logic.GetCmdChain(useEntryPoint, hash, args)
-	res, err := osrunner.StartAndWait(cmds, cmdOut)
+// checkSources shows COPY and ADD sources matching no files before docker build fails
+// on them. They fail the build unless missing_sources is "warn".
+func (cfg Config) checkSources(r reporter, workDir, dockerFile string) error {
+	unmatched, err := logic.UnmatchedSources(workDir, dockerFile)
 	if err != nil {
-		return "", err
+		return err
+	}
+	for _, source := range unmatched {
+		message := fmt.Sprintf("%s:%d: %s %s matches no files", dockerFile, source.Line, source.Instruction, source.Path)
+		if cfg.MissingSources == "warn" {
+			r.Warn(" --->", "warning! "+message)
+		} else {
+			r.Println(" --->", message)
+		}
+	}
+	if len(unmatched) > 0 && cfg.MissingSources != "warn" {
+		return fmt.Errorf("%d COPY/ADD sources match no files", len(unmatched))
+	}
+	return nil
+}
+
+// hashEntries are "config" entries of settings changing the built image in canonical
+// order. Settings of facts and tags are left out, changing them doesn't rebuild.
+func (cfg Config) hashEntries() hash.Manifest {
+	entries := make(hash.Manifest, 0)
+	if cfg.Target != "" {
+		entries = append(entries, hash.Entry{Kind: "config", Name: "target", Digest: hash.EscapeValue(cfg.Target)})
 	}
-	return strings.TrimSpace(string(res)), nil
+	if cfg.Platform != "" {
+		entries = append(entries, hash.Entry{Kind: "config", Name: "platform", Digest: hash.EscapeValue(cfg.Platform)})
+	}
+	for _, name := range sortedKeys(cfg.BuildArgs) {
+		entries = append(entries, hash.Entry{Kind: "config", Name: "build-arg." + name,
+			Digest: hash.EscapeValue(cfg.BuildArgs[name])})
+	}
+	return entries
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func loadFactsYaml(yamlFile []byte) []DefInternal {
-	defs := Defs{}
-	err := yaml.Unmarshal(yamlFile, &defs)
+// saveManifest keeps the manifest of the hash tag. Another manifest saved for the
+// same hash tag before is a collision: the hash is too short to tell the inputs apart.
+func saveManifest(hashName, hashTag string, manifest hash.Manifest) error {
+	saved, err := cache.LoadManifest(hashName, hashTag)
+	if err := cache.SaveManifest(hashName, hashTag, manifest); err != nil {
+		return fmt.Errorf("manifest cache: %w", err)
+	}
+	if err == nil && saved.String() != manifest.Public().String() {
+		return fmt.Errorf("hash collision: %s:%s was calculated from other inputs before, "+
+			"increase hash length", hashName, hashTag)
+	}
+	return nil
+}
+
+// checkManifestLabel compares the manifest with the label of the existing image of the hash tag,
+// images without the label (or when it can't be read) are not checked.
+func (b Builder) checkManifestLabel(ctx context.Context, image string, manifest hash.Manifest) error {
+	label, err := b.manifestLabel(ctx, image)
+	if err != nil || label == "" {
+		return nil
+	}
+	if label == manifest.Digest() {
+		return nil
+	}
+	if saved, err := hash.ParseManifest(label); err == nil && saved.String() == manifest.String() {
+		return nil
+	}
+	return fmt.Errorf("hash collision: %s was built from other inputs, increase hash length", image)
+}
+
+func readConfig(configName string) (Config, error) {
+	cfg := Config{}
+	yamlFile, err := os.ReadFile(configName)
 	if err != nil {
-		log.Printf("error: %v", err)
-		return []DefInternal{}
+		return Config{}, err
+	}
+	if err := yaml.Unmarshal(yamlFile, &cfg); err != nil {
+		return Config{}, err
+	}
+	for _, mask := range cfg.Tags {
+		if err := logic.CheckMask(mask); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", configName, err)
+		}
 	}
-	return defs.Facts
+	switch cfg.MissingSources {
+	case "", "fail", "warn":
+	default:
+		return Config{}, fmt.Errorf("%s: unknown missing_sources %q, expected fail or warn", configName,
+			cfg.MissingSources)
+	}
+	return cfg, nil
 }
 
-func loadAllFacts() map[string][]string {
-	globalFacts := make(map[string][]string, 0)
-	fmt.Println(" ---> assets")
-	for _, asset := range AssetNames() {
-		fmt.Println(" ----> asset", asset)
-		data, _ := Asset(asset)
-		facts := loadFactsYaml(data)
-		for _, fact := range facts {
-			globalFacts[fact.Name] = fact.Args
+func RunCmdChain(ctx context.Context, runner osrunner.Runner, timeout time.Duration, useEntryPoint bool,
+	hash string, args []string) (string, error) {
+	ctx, cancel := osrunner.WithTimeout(ctx, timeout)
+	defer cancel()
+	containerName := "sdb-fact-" + strconv.Itoa(os.Getpid()) + "-" +
+		strconv.FormatInt(atomic.AddInt64(&factContainerCounter, 1), 10)
+	res, err := runner.Run(ctx, logic.GetCmdChain(useEntryPoint, hash, containerName, args))
+	if err != nil {
+		// a docker client killed by a timeout or by a failed start of a later stage leaves the container
+		stages := osrunner.StageResults(err)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+			(len(stages) > 1 && stages[0].ExitCode == -1) {
+			removeContainer(runner, containerName)
 		}
+		return "", err
 	}
-	return globalFacts
+	return strings.TrimSpace(string(res.Stdout)), nil
+}
+
+// removeContainer kills a fact container left after an interrupted docker run.
+func removeContainer(runner osrunner.Runner, containerName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), osrunner.WaitDelay)
+	defer cancel()
+	_, _ = runner.Run(ctx, osrunner.NewPipeline("docker", "rm", "-f", containerName))
+}
+
+func runCommand(ctx context.Context, runner osrunner.Runner, timeout time.Duration,
+	args []string) (osrunner.Result, error) {
+	return runCommandPipeline(ctx, runner, timeout, osrunner.NewPipeline(args...))
 }
 
-func (cfg Config) GatheringFacts(hash string) map[string]string {
-	globalFacts := loadAllFacts()
+func runCommandPipeline(ctx context.Context, runner osrunner.Runner, timeout time.Duration,
+	pipeline osrunner.Pipeline) (osrunner.Result, error) {
+	ctx, cancel := osrunner.WithTimeout(ctx, timeout)
+	defer cancel()
+	return runner.Run(ctx, pipeline)
+}
+
+func loadFacts(out io.Writer, workDir string, extraDirs []string) (*facts.Registry, error) {
+	err := facts.CheckDirs(extraDirs)
+	var registry *facts.Registry
+	if err == nil {
+		registry, err = facts.Load(facts.Dirs(workDir, extraDirs))
+	}
+	if err != nil {
+		fmt.Fprintln(out, " -> facts:", err)
+		return nil, err
+	}
+	for _, override := range registry.Overrides {
+		fmt.Fprintln(out, " ---> fact "+override.Fact.Name+": warning! "+override.Fact.Source+" overrides",
+			override.Previous.Source)
+	}
+	return registry, nil
+}
 
-	facts := make(map[string]string)
+func printFacts(registry *facts.Registry) {
+	fmt.Println(" --> facts")
+	for _, fact := range registry.List() {
+		fmt.Println(" ---> fact:", fact.Name, "<-", fact.Source)
+	}
+}
+
+func (cfg Config) GatheringFacts(ctx context.Context, r reporter, runner osrunner.Runner, hash string,
+	registry *facts.Registry, timeout time.Duration) (map[string]string, error) {
+	factValues := make(map[string]string)
 	for _, def := range cfg.Facts {
+		args := def.Args
 		if def.CmdName != "" {
-			facts = calcFact(facts, def.Name, hash, globalFacts[def.CmdName])
-		} else {
-			facts = calcFact(facts, def.Name, hash, def.Args)
+			globalFact, ok := registry.Lookup(def.CmdName)
+			if !ok {
+				r.Warn(" --->", "fact "+def.Name+" skipped! unknown cmd "+def.CmdName)
+				continue
+			}
+			args = globalFact.Args
+		}
+		if err := calcFact(ctx, r, runner, factValues, def.Name, hash, args, cfg.factTimeout(def, timeout)); err != nil {
+			return factValues, err
 		}
 	}
-	return facts
+	return factValues, nil
 }
 
-func calcFact(facts map[string]string, name, hash string, args []string) map[string]string {
-	value, err := RunCmdChain(true, hash, args)
+func (cfg Config) factTimeout(def Def, timeout time.Duration) time.Duration {
+	if def.Timeout > 0 {
+		return def.Timeout
+	}
+	if cfg.FactTimeout > 0 {
+		return cfg.FactTimeout
+	}
+	return timeout
+}
+
+func calcFact(ctx context.Context, r reporter, runner osrunner.Runner, facts map[string]string,
+	name, hash string, args []string, timeout time.Duration) error {
+	value, err := RunCmdChain(ctx, runner, timeout, true, hash, args)
 	if err != nil {
-		fmt.Println(" ---> fact "+name+" skipped!", err)
-		return facts
+		r.Warn(" --->", "fact "+name+" skipped! "+err.Error())
+		r.Fail("fact "+name, err)
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return err
+		}
+		return nil
 	}
-	fmt.Println(" ---> fact:", name, "=", value)
+	r.Println(" ---> fact:", name, "=", value)
 	facts[name] = value
-	return facts
+	return nil
 }
 
-func (cfg Config) DoRules(hashName, hashTag string,
-	facts map[string]string, isPush bool, prefixes []string) int {
-	fmt.Println(" --> create tags")
-	for _, mask := range cfg.Tags {
-		fmt.Println(" ---> mask", mask)
-		if err := logic.TagsProcessing(mask, facts, func(tagName string) error {
-			fmt.Println(" ----> tag", tagName)
-			if err := createDockerTag(hashName+":"+hashTag, hashName+":"+tagName).Run(); err != nil {
-				fmt.Println(" ----> tag: warning! ", err)
+// DoRules tags and pushes the image by the masks, masks failing to expand don't stop
+// the other ones but fail the run.
+func (cfg Config) DoRules(ctx context.Context, r reporter, runner osrunner.Runner, timeout time.Duration,
+	hashName, hashTag string, facts map[string]string, isPush bool) int {
+	r.Println(" --> create tags")
+	operations, planErr := cfg.PlanTags(hashName, hashTag, facts, isPush)
+	if planErr != nil {
+		r.Println(" ---> ", planErr)
+		r.Fail("tags", planErr)
+	}
+	r.addTags(operations)
+	for i, operation := range operations {
+		if i == 0 || operation.Mask != operations[i-1].Mask {
+			r.Println(" ---> mask", operation.Mask)
+		}
+		if i == 0 || operation.Tag != operations[i-1].Tag {
+			r.Println(" ----> tag", operation.Tag)
+		}
+		var err error
+		if operation.Kind == "push" {
+			var res osrunner.Result
+			if res, err = runCommand(ctx, runner, timeout, operation.Args); err != nil {
+				r.Println(" ----> push:  ", err)
+				r.Fail("push", err)
+			} else {
+				r.addPush(operation, res.Stdout)
 			}
-			for _, prefix := range prefixes {
-				hashNameWithPrefix := prefix + "/" + hashName
-				if strings.HasSuffix(prefix, "/") {
-					hashNameWithPrefix = prefix + hashName
-				}
-				if err := createDockerTag(hashName+":"+hashTag, hashNameWithPrefix+":"+tagName).Run(); err != nil {
-					fmt.Println(" ----> tag: warning! ", err)
-				}
+		} else {
+			err = runTag(ctx, r, runner, timeout, operation.Args)
+		}
+		if err != nil {
+			r.Println(" --> aborted")
+			return exitCode(err)
+		}
+	}
+	if planErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// PlanTags expands every tag mask into tag and push operations for the image and all prefixes,
+// errors of masks are joined and the other masks are planned anyway.
+func (cfg Config) PlanTags(hashName, hashTag string, facts map[string]string, isPush bool) ([]Operation, error) {
+	operations := make([]Operation, 0)
+	var errs []error
+	for _, mask := range cfg.Tags {
+		err := logic.TagsProcessing(mask, facts, func(tagName string) error {
+			operations = append(operations, Operation{Kind: "tag", Mask: mask, Tag: tagName,
+				Args: createDockerTag(hashName+":"+hashTag, hashName+":"+tagName)})
+			for _, prefix := range cfg.Prefixes {
+				hashNameWithPrefix := prefixedName(prefix, hashName)
+				operations = append(operations, Operation{Kind: "tag", Mask: mask, Tag: tagName,
+					Args: createDockerTag(hashName+":"+hashTag, hashNameWithPrefix+":"+tagName)})
 				if isPush {
-					if err := pushDockerImage(hashNameWithPrefix, tagName).Run(); err != nil {
-						fmt.Println(" ----> push:  ", err)
-						return err
-					}
+					operations = append(operations, Operation{Kind: "push", Mask: mask, Tag: tagName,
+						Args: pushDockerImage(hashNameWithPrefix, tagName)})
 				}
 			}
 			return nil
-		}); err != nil {
-			fmt.Println(" --> aborted")
-			return 1
+		})
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
-	return 0
+	return operations, errors.Join(errs...)
+}
+
+func prefixedName(prefix, name string) string {
+	if strings.HasSuffix(prefix, "/") {
+		return prefix + name
+	}
+	return prefix + "/" + name
+}
+
+// runTag only warns about failed tags, timeouts and interrupts abort the run.
+func runTag(ctx context.Context, r reporter, runner osrunner.Runner, timeout time.Duration, args []string) error {
+	_, err := runCommand(ctx, runner, timeout, args)
+	if err == nil {
+		return nil
+	}
+	r.Warn(" ----> tag:", "warning! "+err.Error())
+	r.Fail("tag", err)
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+		return err
+	}
+	return nil
+}
+
+// dockerBuildArgs labels the image with the manifest of its hash tag for "hash -diff",
+// no label is added for a nil manifest.
+func (cfg Config) dockerBuildArgs(dockerFile, image string, manifest hash.Manifest) []string {
+	args := []string{"docker", "build", "-t", image, "-f", dockerFile}
+	if cfg.Target != "" {
+		args = append(args, "--target", cfg.Target)
+	}
+	if cfg.Platform != "" {
+		args = append(args, "--platform", cfg.Platform)
+	}
+	for _, name := range sortedKeys(cfg.BuildArgs) {
+		args = append(args, "--build-arg", name+"="+cfg.BuildArgs[name])
+	}
+	if manifest != nil {
+		args = append(args, "--label", hash.ManifestLabel+"="+manifest.Digest())
+	}
+	return append(args, ".")
+}
+
+// shortArgs hides values of sdb labels, they are too long to show.
+func shortArgs(args []string) []string {
+	short := make([]string, len(args))
+	for i, arg := range args {
+		short[i] = arg
+		if i > 0 && args[i-1] == "--label" && strings.HasPrefix(arg, "sdb.") {
+			short[i] = arg[:strings.Index(arg, "=")+1] + "..."
+		}
+	}
+	return short
 }
 
-func pushDockerImage(imageName, imageTag string) *exec.Cmd {
-	return osrunner.Command("docker", "image", imageName+":"+imageTag)
+func pushDockerImage(imageName, imageTag string) []string {
+	return []string{"docker", "image", "push", imageName + ":" + imageTag}
 }
 
-func createDockerTag(imageName1, imageName2 string) *exec.Cmd {
-	return osrunner.Command("docker", "image", "tag", imageName1, imageName2)
+func createDockerTag(imageName1, imageName2 string) []string {
+	return []string{"docker", "image", "tag", imageName1, imageName2}
 }
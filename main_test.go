@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/abatalev/smartdockerbuild/internal/cache"
+	"github.com/abatalev/smartdockerbuild/internal/facts"
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/logic"
+	"github.com/abatalev/smartdockerbuild/internal/osrunner"
 	"github.com/stretchr/testify/require"
 )
 
@@ -31,16 +41,45 @@ func createFileContent(dirName string, content FileContent) error {
 	return os.WriteFile(fileName, []byte(content.content), 0644)
 }
 
-func TestLoadDefs(t *testing.T) {
-	assertions := require.New(t)
-	assertions.Len(loadAllFacts(), 3)
+func record(stdout string, args ...string) osrunner.Record {
+	return osrunner.Record{Pipeline: osrunner.NewPipeline(args...), Stdout: stdout}
+}
+
+func failedRecord(err string, exitCode int, args ...string) osrunner.Record {
+	return osrunner.Record{
+		Pipeline: osrunner.NewPipeline(args...),
+		Stages:   []osrunner.StageResult{{Args: args, ExitCode: exitCode, Stderr: "oops"}},
+		Error:    err,
+	}
+}
+
+func buildArgs(workDir, dockerFile, image string, upstream map[string]string) []string {
+	_, manifest, _ := logic.CalcHashInputs(workDir, dockerFile, upstream)
+	return Config{}.dockerBuildArgs(dockerFile, image, manifest)
+}
+
+func calcHashInputs(t *testing.T, workDir, dockerFile string, upstream map[string]string) (string, hash.Manifest) {
+	hashTag, manifest, err := logic.CalcHashInputs(workDir, dockerFile, upstream)
+	require.NoError(t, err)
+	return hashTag, manifest
+}
+
+func calcHash(t *testing.T, workDir, dockerFile string) string {
+	hashTag, _ := calcHashInputs(t, workDir, dockerFile, nil)
+	return hashTag
+}
+
+func factRecord(stdout, hash string, args ...string) osrunner.Record {
+	return osrunner.Record{Pipeline: logic.GetCmdChain(true, hash, "sdb-fact", args), Stdout: stdout}
 }
 
 func TestBuildDockerImage(t *testing.T) {
 	variants := []struct {
 		files      []FileContent
 		force      bool
+		push       bool
 		dockerFile string
+		records    func(workDir, hash string) []osrunner.Record
 		result     int
 	}{
 		{
@@ -50,7 +89,12 @@ func TestBuildDockerImage(t *testing.T) {
 			},
 			force:      true,
 			dockerFile: "Dockerfile",
-			result:     0,
+			records: func(workDir, hash string) []osrunner.Record {
+				return []osrunner.Record{
+					record("", buildArgs(workDir, "Dockerfile", "v0:"+hash, nil)...),
+				}
+			},
+			result: 0,
 		},
 		{
 			files: []FileContent{
@@ -59,18 +103,739 @@ func TestBuildDockerImage(t *testing.T) {
 			},
 			force:      true,
 			dockerFile: "Dockerfile.xxx",
-			result:     0,
+			records: func(workDir, hash string) []osrunner.Record {
+				return []osrunner.Record{
+					record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hash, nil)...),
+				}
+			},
+			result: 0,
+		},
+		{
+			files: []FileContent{
+				{name: "xxx.sdb.yaml", content: "name: a/xxx\n" +
+					"prefixes: [\"registry\"]\n" +
+					"facts:\n" +
+					"  - name: os-name\n" +
+					"    cmd: os-name\n" +
+					"  - name: v\n" +
+					"    args: [\"cat\", \"/v\"]\n" +
+					"tags:\n" +
+					"  - \"$os-name|-|@v\"\n"},
+				{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+			},
+			push:       true,
+			dockerFile: "Dockerfile.xxx",
+			records: func(workDir, hash string) []osrunner.Record {
+				registry, _ := facts.Load([]string{})
+				osName, _ := registry.Lookup("os-name")
+				return []osrunner.Record{
+					record("REPOSITORY TAG IMAGE ID CREATED SIZE\na/xxx "+hash+" 4048db5d3672 6 weeks ago 7.83MB\n",
+						"docker", "image", "list"),
+					factRecord("alpine\n", "a/xxx:"+hash, osName.Args...),
+					factRecord("1.2\n", "a/xxx:"+hash, "cat", "/v"),
+					record("", "docker", "image", "tag", "a/xxx:"+hash, "a/xxx:alpine-1"),
+					record("", "docker", "image", "tag", "a/xxx:"+hash, "registry/a/xxx:alpine-1"),
+					record("", "docker", "image", "push", "registry/a/xxx:alpine-1"),
+					record("", "docker", "image", "tag", "a/xxx:"+hash, "a/xxx:alpine-1.2"),
+					record("", "docker", "image", "tag", "a/xxx:"+hash, "registry/a/xxx:alpine-1.2"),
+					record("", "docker", "image", "push", "registry/a/xxx:alpine-1.2"),
+				}
+			},
+			result: 0,
+		},
+		{
+			files: []FileContent{
+				{name: "xxx.sdb.yaml", content: ""},
+				{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+			},
+			dockerFile: "Dockerfile.xxx",
+			records: func(workDir, hash string) []osrunner.Record {
+				return []osrunner.Record{
+					record("", "docker", "image", "list"),
+					failedRecord("exit status 2", 2, buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hash, nil)...),
+				}
+			},
+			result: 2,
+		},
+		{
+			files: []FileContent{
+				{name: "xxx.sdb.yaml", content: "facts:\n  - name: v\n    args: [\"cat\"]\ntags: [\"$v\"]\n"},
+				{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+			},
+			force:      true,
+			dockerFile: "Dockerfile.xxx",
+			records: func(workDir, hash string) []osrunner.Record {
+				return []osrunner.Record{
+					record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hash, nil)...),
+					{Pipeline: logic.GetCmdChain(true, "xxx:"+hash, "sdb-fact", []string{"cat"}), Error: "context deadline exceeded"},
+					record("", "docker", "rm", "-f", "sdb-fact"),
+				}
+			},
+			result: exitTimeout,
+		},
+		{
+			files: []FileContent{
+				{name: "xxx.sdb.yaml", content: "facts:\n  - name: v\n    args: [\"cat\"]\ntags: [\"$v\"]\n"},
+				{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+			},
+			force:      true,
+			dockerFile: "Dockerfile.xxx",
+			records: func(workDir, hash string) []osrunner.Record {
+				return []osrunner.Record{
+					record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hash, nil)...),
+					factRecord("1\n", "xxx:"+hash, "cat"),
+					failedRecord("exit status 1", 1, "docker", "image", "tag", "xxx:"+hash, "xxx:1"),
+				}
+			},
+			result: 0,
 		},
 	}
 	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	registry, err := facts.Load([]string{})
+	assertions.NoError(err)
 	for n, variant := range variants {
 		workDir := filepath.Join(t.TempDir(), "v"+strconv.Itoa(n))
 		assertions.NoError(os.Mkdir(workDir, 0755))
 		assertions.NoError(createFilesContent(workDir, variant.files))
-		assertions.Equal(variant.result, BuildDockerImage(workDir, variant.dockerFile, variant.force, false), n)
+		options := Options{isForce: variant.force, isPush: variant.push, Dockerfiles: []string{variant.dockerFile}}
+		runner := osrunner.NewReplayer(variant.records(workDir, calcHash(t, workDir, variant.dockerFile)))
+		builder := Builder{Runner: runner, Registry: registry, Options: options}
+		assertions.Equal(variant.result, builder.BuildDockerImage(context.Background(), workDir), n)
+		assertions.Empty(runner.Unused(), n)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: "facts:\n  - name: v\n    args: [\"cat\"]\ntags: [\"$v\"]\n"},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+	}))
+	hashTag := calcHash(t, workDir, "Dockerfile.xxx")
+	assertions.NoError(cache.SaveFacts("xxx", hashTag, map[string]string{"v": "1"}))
+
+	for _, isForce := range []bool{false, true} {
+		records := []osrunner.Record{}
+		if !isForce {
+			records = append(records, record("xxx "+hashTag+" 1 2 3\n", "docker", "image", "list"))
+		}
+		runner := osrunner.NewReplayer(records)
+		options := Options{isDryRun: true, isForce: isForce, isPush: true, Dockerfiles: []string{"Dockerfile.xxx"}}
+		builder := Builder{Runner: runner, Options: options}
+		assertions.Equal(0, builder.BuildDockerImage(context.Background(), workDir))
+		assertions.Empty(runner.Unused())
+	}
+}
+
+func TestBuildAll(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "images", "a"), 0755))
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "images", "b"), 0755))
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "images/a/a.sdb.yaml", content: ""},
+		{name: "images/a/Dockerfile", content: "FROM alpine:latest"},
+		{name: "images/b/b.sdb.yaml", content: ""},
+		{name: "images/b/Dockerfile", content: "FROM alpine:3.20"},
+	}))
+	hashA := calcHash(t, workDir, "images/a/Dockerfile")
+	hashB := calcHash(t, workDir, "images/b/Dockerfile")
+	runner := osrunner.NewReplayer([]osrunner.Record{
+		record("a "+hashA+" 1 2 3\n", "docker", "image", "list"),
+		failedRecord("exit status 3", 3, buildArgs(workDir, "images/b/Dockerfile", "b:"+hashB, nil)...),
+	})
+	builder := Builder{Runner: runner, Options: Options{Dockerfiles: []string{"images/**/Dockerfile*"}}, Out: io.Discard}
+	summary := builder.BuildAll(context.Background(), workDir)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(3, summary.ExitCode)
+	assertions.Len(summary.Images, 2)
+	assertions.Equal("skip", summary.Images[0].Build.Decision)
+	assertions.Equal(0, summary.Images[0].ExitCode)
+	assertions.Equal(3, summary.Images[1].ExitCode)
+
+	builder.Options.Dockerfiles = []string{"images/**/*.Dockerfile"}
+	assertions.Equal(1, builder.BuildAll(context.Background(), workDir).ExitCode)
+}
+
+func TestBuildDependencies(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "images", "app"), 0755))
+	assertions.NoError(os.MkdirAll(filepath.Join(workDir, "images", "base"), 0755))
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "images/app/app.sdb.yaml", content: ""},
+		{name: "images/app/Dockerfile", content: "FROM registry/company/base:latest\n"},
+		{name: "images/base/base.sdb.yaml", content: "name: company/base\nprefixes: [\"registry\"]\n"},
+		{name: "images/base/Dockerfile", content: "FROM alpine:3.20\n"},
+	}))
+	hashBase := calcHash(t, workDir, "images/base/Dockerfile")
+	hashApp, _ := calcHashInputs(t, workDir, "images/app/Dockerfile", map[string]string{"company/base": hashBase})
+	assertions.NotEqual(calcHash(t, workDir, "images/app/Dockerfile"), hashApp)
+
+	runner := osrunner.NewReplayer([]osrunner.Record{
+		record("", "docker", "image", "list"),
+		record("", buildArgs(workDir, "images/base/Dockerfile", "company/base:"+hashBase, nil)...),
+		record("", buildArgs(workDir, "images/app/Dockerfile", "app:"+hashApp, map[string]string{"company/base": hashBase})...),
+	})
+	builder := Builder{Runner: runner, Options: Options{Dockerfiles: []string{"images"}}, Out: io.Discard}
+	summary := builder.BuildAll(context.Background(), workDir)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(0, summary.ExitCode)
+	assertions.Equal("images/base/Dockerfile", summary.Images[0].Dockerfile)
+	assertions.Equal(hashApp, summary.Images[1].HashTag)
+
+	runner = osrunner.NewReplayer([]osrunner.Record{
+		record("", "docker", "image", "list"),
+		failedRecord("exit status 2", 2, buildArgs(workDir, "images/base/Dockerfile", "company/base:"+hashBase, nil)...),
+	})
+	builder.Runner = runner
+	builder.Options.isKeepGoing = true
+	summary = builder.BuildAll(context.Background(), workDir)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(2, summary.ExitCode)
+	assertions.Equal(1, summary.Images[1].ExitCode)
+	assertions.Equal("upstream", summary.Images[1].Errors[0].Operation)
+}
+
+func TestBuildParallel(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	files := []FileContent{{name: "app.sdb.yaml", content: ""},
+		{name: "Dockerfile.app", content: "FROM a\nFROM b\n"}}
+	for _, name := range []string{"a", "b", "c"} {
+		files = append(files, FileContent{name: name + ".sdb.yaml", content: ""},
+			FileContent{name: "Dockerfile." + name, content: "FROM alpine:" + name + "\n"})
+	}
+	assertions.NoError(createFilesContent(workDir, files))
+	hashTags := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		hashTags[name] = calcHash(t, workDir, "Dockerfile."+name)
+	}
+	hashApp, _ := calcHashInputs(t, workDir, "Dockerfile.app", map[string]string{"a": hashTags["a"], "b": hashTags["b"]})
+	records := []osrunner.Record{
+		record("", "docker", "image", "list"),
+		failedRecord("exit status 2", 2, buildArgs(workDir, "Dockerfile.c", "c:"+hashTags["c"], nil)...),
+		record("", buildArgs(workDir, "Dockerfile.app", "app:"+hashApp, map[string]string{"a": hashTags["a"], "b": hashTags["b"]})...),
+	}
+	for _, name := range []string{"a", "b"} {
+		records = append(records, record("", buildArgs(workDir, "Dockerfile."+name, name+":"+hashTags[name], nil)...))
+	}
+
+	variants := []struct {
+		keepGoing bool
+		jobs      int
+	}{
+		{keepGoing: true, jobs: 4},
+		{keepGoing: true, jobs: 1},
+	}
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer(records)
+		out := &strings.Builder{}
+		options := Options{Dockerfiles: []string{"Dockerfile.*"}, Jobs: variant.jobs, isKeepGoing: variant.keepGoing}
+		summary := Builder{Runner: runner, Options: options, Out: out}.BuildAll(context.Background(), workDir)
+		assertions.Empty(runner.Unused(), n)
+		assertions.Equal(2, summary.ExitCode, n)
+		assertions.Len(summary.Images, 4, n)
+		assertions.Equal("Dockerfile.app", summary.Images[2].Dockerfile, n)
+		assertions.Equal(0, summary.Images[2].ExitCode, n)
+		assertions.Contains(out.String(), " -> file Dockerfile.app\n --> build app:"+hashApp+"\n", n)
+	}
+
+	runner := osrunner.NewReplayer(records)
+	options := Options{Dockerfiles: []string{"Dockerfile.c", "Dockerfile.*"}, Jobs: 1}
+	summary := Builder{Runner: runner, Options: options, Out: io.Discard}.BuildAll(context.Background(), workDir)
+	assertions.Equal(2, summary.ExitCode)
+	assertions.Len(runner.Unused(), 3)
+	for _, report := range summary.Images[1:] {
+		assertions.Equal("aborted", report.Build.Decision)
+	}
+}
+
+func TestAffected(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	for _, dir := range []string{"app", "base", "other"} {
+		assertions.NoError(os.MkdirAll(filepath.Join(workDir, "images", dir), 0755))
+	}
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "images/app/app.sdb.yaml", content: ""},
+		{name: "images/app/Dockerfile", content: "FROM base:latest\nCOPY images/app/ /opt\n"},
+		{name: "images/app/main.go", content: "package main\n"},
+		{name: "images/base/base.sdb.yaml", content: "hash_exclude: [\"**/*.md\"]\n"},
+		{name: "images/base/Dockerfile", content: "FROM alpine:3.20\nCOPY images/base/ /opt\n"},
+		{name: "images/base/main.go", content: "package main\n"},
+		{name: "images/other/other.sdb.yaml", content: "hash_inputs:\n  files: [\"go.sum\"]\n"},
+		{name: "images/other/Dockerfile", content: "FROM alpine:3.20\n"},
+	}))
+	gitRecords := func(diff, untracked string) []osrunner.Record {
+		return []osrunner.Record{
+			record(diff, "git", "diff", "--name-only", "--no-renames", "--relative", "main", "--"),
+			record(untracked, "git", "ls-files", "--others", "--exclude-standard"),
+		}
+	}
+	variants := []struct {
+		diff      string
+		untracked string
+		result    []string
+	}{
+		{diff: "images/base/main.go\n", result: []string{"images/base/Dockerfile", "images/app/Dockerfile"}},
+		{untracked: "images/app/new.go\n", result: []string{"images/app/Dockerfile"}},
+		{diff: "images/other/other.sdb.yaml\nreadme.md\n", result: []string{"images/other/Dockerfile"}},
+		{diff: "readme.md\n", result: []string{}},
+		{diff: "go.sum\n", result: []string{"images/other/Dockerfile"}},
+		{diff: "images/base/readme.md\n", result: []string{}},
+	}
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer(gitRecords(variant.diff, variant.untracked))
+		builder := Builder{Runner: runner, Options: Options{Command: "affected", Since: "main"}, Out: io.Discard}
+		affected, err := builder.Affected(context.Background(), workDir)
+		assertions.NoError(err, n)
+		assertions.Equal(variant.result, affected, n)
+	}
+
+	hashBase := calcHash(t, workDir, "images/base/Dockerfile")
+	hashApp, _ := calcHashInputs(t, workDir, "images/app/Dockerfile", map[string]string{"base": hashBase})
+	runner := osrunner.NewReplayer(append(gitRecords("images/app/main.go\n", ""),
+		record("", "docker", "image", "list"),
+		record("", buildArgs(workDir, "images/app/Dockerfile", "app:"+hashApp, map[string]string{"base": hashBase})...),
+	))
+	options := Options{Command: "affected", Since: "main", isBuild: true}
+	summary := Builder{Runner: runner, Options: options, Out: io.Discard}.RunAffected(context.Background(), workDir)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(0, summary.ExitCode)
+	assertions.Len(summary.Images, 1)
+
+	runner = osrunner.NewReplayer(gitRecords("images/base/main.go\n", ""))
+	options = Options{Command: "affected", Since: "main", Output: "json"}
+	summary = Builder{Runner: runner, Options: options, Out: io.Discard}.RunAffected(context.Background(), workDir)
+	assertions.Equal([]string{"images/base/Dockerfile", "images/app/Dockerfile"}, summary.Affected)
+
+	// an argument which isn't a Dockerfile is rejected before git is called
+	options.isBuild = true
+	options.Dockerfiles = []string{"images", "notes.txt"}
+	runner = osrunner.NewReplayer(nil)
+	summary = Builder{Runner: runner, Options: options, Out: io.Discard}.RunAffected(context.Background(), workDir)
+	assertions.Equal(1, summary.ExitCode)
+	assertions.Equal("unknown Dockerfile name notes.txt", summary.Error)
+
+	_, err := Builder{Runner: osrunner.NewReplayer(nil), Out: io.Discard}.Affected(context.Background(), workDir)
+	assertions.Error(err)
+}
+
+func TestCommands(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: "facts:\n  - name: v\n    args: [\"cat\"]\ntags: [\"$v\"]\n"},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+		{name: "yyy.sdb.yaml", content: ""},
+		{name: "Dockerfile.yyy", content: "FROM xxx:1"},
+	}))
+	hashTag := calcHash(t, workDir, "Dockerfile.xxx")
+	hashY, _ := calcHashInputs(t, workDir, "Dockerfile.yyy", map[string]string{"xxx": hashTag})
+	imageList := record("xxx "+hashTag+" 1 2 3\n", "docker", "image", "list")
+
+	out := &strings.Builder{}
+	builder := Builder{Options: Options{Command: "hash", Dockerfiles: []string{"Dockerfile.xxx"}}, Out: io.Discard}
+	assertions.Equal(0, builder.PrintHashTags(context.Background(), out, workDir))
+	assertions.Equal(hashTag+"\n", out.String())
+	out.Reset()
+	builder.Options.Dockerfiles = []string{"Dockerfile.yyy", "Dockerfile.xxx"}
+	assertions.Equal(0, builder.PrintHashTags(context.Background(), out, workDir))
+	assertions.Equal("Dockerfile.xxx xxx:"+hashTag+"\nDockerfile.yyy yyy:"+hashY+"\n", out.String())
+	builder.Options.Dockerfiles = []string{"Dockerfile.zzz"}
+	assertions.Equal(1, builder.PrintHashTags(context.Background(), out, workDir))
+	builder.Options.Dockerfiles = nil
+	assertions.Equal(1, builder.PrintHashTags(context.Background(), out, workDir))
+
+	variants := []struct {
+		command string
+		records []osrunner.Record
+		result  int
+	}{
+		{command: "facts", records: []osrunner.Record{imageList, factRecord("1\n", "xxx:"+hashTag, "cat")}},
+		{command: "tags", records: []osrunner.Record{imageList, factRecord("1\n", "xxx:"+hashTag, "cat"),
+			record("", "docker", "image", "tag", "xxx:"+hashTag, "xxx:1")}},
+		{command: "inspect", records: []osrunner.Record{imageList}},
+		{command: "tags", records: []osrunner.Record{record("", "docker", "image", "list")}, result: 1},
+	}
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer(variant.records)
+		options := Options{Command: variant.command, isForce: true, Dockerfiles: []string{"Dockerfile.xxx"}}
+		summary := Builder{Runner: runner, Options: options, Out: io.Discard}.BuildAll(context.Background(), workDir)
+		assertions.Empty(runner.Unused(), n)
+		assertions.Equal(variant.result, summary.ExitCode, n)
+		if variant.result == 0 {
+			assertions.Equal(map[string]string{"v": "1"}, summary.Images[0].Facts, n)
+		}
+	}
+
+	builder = Builder{Options: Options{Command: "clean", Dockerfiles: []string{"notes.txt"}}, Out: io.Discard}
+	assertions.Equal(1, builder.Clean(workDir))
+	builder.Options.Dockerfiles = []string{"Dockerfile.xxx"}
+	assertions.Equal(0, builder.Clean(workDir))
+	_, err := cache.LoadFacts("xxx", hashTag)
+	assertions.True(errors.Is(err, os.ErrNotExist))
+}
+
+func TestHashFormat(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: "target: app\nhash:\n  algorithm: sha512\n  length: 16\n" +
+			"  tag: \"{{.Target}}-{{.Hash}}\"\n"},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest AS app"},
+	}))
+	_, manifest := calcHashInputs(t, workDir, "Dockerfile.xxx", nil)
+	manifest = append(manifest, hash.Entry{Kind: "config", Name: "target", Digest: "app"})
+	sum, err := manifest.SumWith("sha512")
+	assertions.NoError(err)
+	hashTag := "app-" + sum[:16]
+
+	options := Options{isDryRun: true, Dockerfiles: []string{"Dockerfile.xxx"}}
+	runner := osrunner.NewReplayer([]osrunner.Record{record("", "docker", "image", "list")})
+	report := Builder{Runner: runner, Options: options, Out: io.Discard}.
+		Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Equal(0, report.ExitCode)
+	assertions.Equal(hashTag, report.HashTag)
+	assertions.Equal([]string{"docker", "build", "-t", "xxx:" + hashTag, "-f", "Dockerfile.xxx", "--target", "app",
+		"--label", hash.ManifestLabel + "=" + manifest.Digest(), "."}, report.Operations[0])
+	assertions.Empty(report.Warnings)
+
+	assertions.NoError(cache.SaveManifest("xxx", hashTag, hash.Manifest{{Kind: "file", Name: "x", Digest: "1"}}))
+	runner = osrunner.NewReplayer([]osrunner.Record{record("", "docker", "image", "list")})
+	report = Builder{Runner: runner, Options: options, Out: io.Discard}.
+		Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Equal(0, report.ExitCode)
+	assertions.Len(report.Warnings, 1)
+	assertions.Contains(report.Warnings[0], "hash collision")
+
+	// the existing image of the hash tag is checked by its label
+	inspect := []string{"docker", "image", "inspect", "--format", "{{ index .Config.Labels \"sdb.manifest\" }}",
+		"xxx:" + hashTag}
+	for label, warnings := range map[string]int{manifest.Digest(): 0, "sha256:0": 1, "<no value>": 0} {
+		runner = osrunner.NewReplayer([]osrunner.Record{record("xxx "+hashTag+" 1 2 3\n", "docker", "image", "list"),
+			record(label+"\n", inspect...)})
+		report = Builder{Runner: runner, Options: options, Out: io.Discard}.
+			Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+		assertions.Equal(0, report.ExitCode, label)
+		assertions.Empty(runner.Unused(), label)
+		assertions.Len(report.Warnings, warnings, label)
+	}
+
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: "hash:\n  tag: \"{{.Name}}\"\n"},
+	}))
+	report = Builder{Runner: osrunner.NewReplayer(nil), Options: options, Out: io.Discard}.
+		Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Equal(1, report.ExitCode)
+	assertions.Equal("hash", report.Errors[0].Operation)
+}
+
+func TestConfigHashInputs(t *testing.T) {
+	assertions := require.New(t)
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{{name: "Dockerfile.xxx", content: "FROM alpine"}}))
+	cfg := Config{Target: "app", Platform: "linux/arm64", BuildArgs: map[string]string{"B": "2", "A": "1 2"}}
+	assertions.Equal([]string{"docker", "build", "-t", "xxx:1", "-f", "Dockerfile.xxx", "--target", "app",
+		"--platform", "linux/arm64", "--build-arg", "A=1 2", "--build-arg", "B=2", "."},
+		cfg.dockerBuildArgs("Dockerfile.xxx", "xxx:1", nil))
+
+	hashTag, manifest, err := cfg.hashInputs(workDir, "Dockerfile.xxx", "xxx", nil)
+	assertions.NoError(err)
+	assertions.Subset(manifest.Lines(), []string{"config:target app", "config:platform linux/arm64",
+		"config:build-arg.A 1%202", "config:build-arg.B 2"})
+
+	variants := []struct {
+		cfg    Config
+		isSame bool
+	}{
+		{cfg: Config{Target: "app", Platform: "linux/arm64", BuildArgs: map[string]string{"A": "1 2", "B": "2"},
+			Prefixes: []string{"r1"}, Tags: []string{"$v"}, Facts: []Def{{Name: "v"}}}, isSame: true},
+		{cfg: Config{Target: "app", Platform: "linux/arm64", BuildArgs: map[string]string{"A": "1 2", "B": "3"}}},
+		{cfg: Config{Target: "app", Platform: "linux/amd64", BuildArgs: map[string]string{"A": "1 2", "B": "2"}}},
+		{cfg: Config{Platform: "linux/arm64", BuildArgs: map[string]string{"A": "1 2", "B": "2"}}},
+		{cfg: Config{}},
+	}
+	for n, variant := range variants {
+		otherTag, _, err := variant.cfg.hashInputs(workDir, "Dockerfile.xxx", "xxx", nil)
+		assertions.NoError(err, n)
+		assertions.Equal(variant.isSame, hashTag == otherTag, n)
+	}
+}
+
+func TestMissingSources(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: ""},
+		{name: "Dockerfile.xxx", content: "FROM alpine\nCOPY app.sh /opt/\n"},
+	}))
+	hashTag := calcHash(t, workDir, "Dockerfile.xxx")
+	runner := osrunner.NewReplayer([]osrunner.Record{record("", "docker", "image", "list")})
+	report := Builder{Runner: runner, Out: io.Discard}.Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(1, report.ExitCode)
+	assertions.Equal("sources", report.Errors[0].Operation)
+
+	assertions.NoError(createFilesContent(workDir, []FileContent{{name: "xxx.sdb.yaml", content: "missing_sources: warn\n"}}))
+	runner = osrunner.NewReplayer([]osrunner.Record{
+		record("", "docker", "image", "list"),
+		record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hashTag, nil)...),
+	})
+	report = Builder{Runner: runner, Out: io.Discard}.Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(0, report.ExitCode)
+	assertions.Equal([]string{"warning! Dockerfile.xxx:2: COPY app.sh matches no files"}, report.Warnings)
+
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: ""},
+		{name: "Dockerfile.xxx", content: "FROM alpine\nARG DIR=app\nCOPY ${DIR}/ /opt/\n"},
+	}))
+	hashTag = calcHash(t, workDir, "Dockerfile.xxx")
+	runner = osrunner.NewReplayer([]osrunner.Record{
+		record("", "docker", "image", "list"),
+		record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hashTag, nil)...),
+	})
+	report = Builder{Runner: runner, Out: io.Discard}.Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Empty(runner.Unused())
+	assertions.Equal(0, report.ExitCode)
+	assertions.Empty(report.Warnings)
+}
+
+func TestHashExplainAndDiff(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: ""},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest\nCOPY a.txt /\n"},
+		{name: "a.txt", content: "a"},
+	}))
+	hashTag, manifest := calcHashInputs(t, workDir, "Dockerfile.xxx", nil)
+	assertions.NoError(os.WriteFile(filepath.Join(workDir, "old.manifest"), []byte(manifest.String()), 0600))
+	oldManifest := manifest.String()
+	assertions.NoError(createFilesContent(workDir, []FileContent{{name: "a.txt", content: "b"}}))
+	newHashTag, newManifest := calcHashInputs(t, workDir, "Dockerfile.xxx", nil)
+	inspect := []string{"docker", "image", "inspect", "--format", "{{ index .Config.Labels \"sdb.manifest\" }}"}
+
+	variants := []struct {
+		explain bool
+		diff    string
+		records []osrunner.Record
+		result  []string
+	}{
+		{
+			explain: true,
+			result: []string{"Dockerfile.xxx xxx:" + newHashTag,
+				"  file Dockerfile.xxx " + newManifest[0].Digest, "  file a.txt " + newManifest[1].Digest,
+				"  sdb version " + hash.Version},
+		},
+		{
+			diff: "old.manifest",
+			result: []string{"Dockerfile.xxx xxx:" + newHashTag,
+				"  ~ file a.txt " + manifest[1].Digest + " -> " + newManifest[1].Digest},
+		},
+		{
+			diff:    "xxx:" + hashTag,
+			records: []osrunner.Record{record(oldManifest+"\n", append(inspect, "xxx:"+hashTag)...)},
+			result: []string{"Dockerfile.xxx xxx:" + newHashTag,
+				"  ~ file a.txt " + manifest[1].Digest + " -> " + newManifest[1].Digest},
+		},
+		{
+			diff:    "xxx:" + newHashTag,
+			records: []osrunner.Record{record(newManifest.Digest()+"\n", append(inspect, "xxx:"+newHashTag)...)},
+			result:  []string{"Dockerfile.xxx xxx:" + newHashTag, "  no changes since xxx:" + newHashTag},
+		},
+	}
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer(variant.records)
+		out := &strings.Builder{}
+		options := Options{Command: "hash", isExplain: variant.explain, DiffWith: variant.diff,
+			Dockerfiles: []string{"Dockerfile.xxx"}}
+		builder := Builder{Runner: runner, Options: options, Out: io.Discard}
+		assertions.Equal(0, builder.PrintHashTags(context.Background(), out, workDir), n)
+		assertions.Equal(strings.Join(variant.result, "\n")+"\n", out.String(), n)
+		assertions.Empty(runner.Unused(), n)
+	}
+
+	for _, label := range []string{"<no value>", "sha256:0"} {
+		runner := osrunner.NewReplayer([]osrunner.Record{record(label+"\n", append(inspect, "yyy")...)})
+		options := Options{Command: "hash", DiffWith: "yyy", Dockerfiles: []string{"Dockerfile.xxx"}}
+		assertions.Equal(1, Builder{Runner: runner, Options: options, Out: io.Discard}.
+			PrintHashTags(context.Background(), io.Discard, workDir), label)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: ""},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest\nCOPY a.txt /\n"},
+		{name: "a.txt", content: "a"},
+	}))
+	builder := Builder{Options: Options{Command: "hash", Dockerfiles: []string{"Dockerfile.xxx"}}, Out: io.Discard}
+	out := &strings.Builder{}
+	assertions.Equal(0, builder.PrintHashTags(context.Background(), out, workDir))
+	hashA := strings.TrimSpace(out.String())
+	_, manifestA := calcHashInputs(t, workDir, "Dockerfile.xxx", nil)
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest\nCOPY b.txt /\n"},
+		{name: "b.txt", content: "b"},
+	}))
+	hashB, manifestB := calcHashInputs(t, workDir, "Dockerfile.xxx", nil)
+	assertions.NoError(cache.SaveManifest("yyy", hashB, manifestB))
+	assertions.NoError(cache.SaveManifest("xxx", hashB, manifestB))
+
+	variants := []struct {
+		refs    []string
+		records []osrunner.Record
+		result  string
+		code    int
+	}{
+		{
+			refs: []string{hashA, "xxx:" + hashB},
+			result: "~ file Dockerfile.xxx " + manifestA[0].Digest + " -> " + manifestB[0].Digest + "\n" +
+				"- file a.txt " + manifestA[1].Digest + "\n" +
+				"+ file b.txt " + manifestB[1].Digest + "\n",
+		},
+		{refs: []string{hashA, hashB}, code: 1},
+		{refs: []string{hashA, "00000000"}, code: 1},
+		{refs: []string{hashA}, code: 1},
+		{
+			refs: []string{"zzz:1", hashA},
+			records: []osrunner.Record{record(manifestA.String(), "docker", "image", "inspect", "--format",
+				"{{ index .Config.Labels \"sdb.manifest\" }}", "zzz:1")},
+		},
+	}
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer(variant.records)
+		out.Reset()
+		builder := Builder{Runner: runner, Options: Options{Command: "diff", Dockerfiles: variant.refs}, Out: io.Discard}
+		assertions.Equal(variant.code, builder.DiffManifests(context.Background(), out, workDir), n)
+		assertions.Equal(variant.result, out.String(), n)
+		assertions.Empty(runner.Unused(), n)
 	}
 }
 
+func TestReport(t *testing.T) {
+	assertions := require.New(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	workDir := t.TempDir()
+	assertions.NoError(createFilesContent(workDir, []FileContent{
+		{name: "xxx.sdb.yaml", content: "prefixes: [\"r1\"]\nfacts:\n  - name: v\n    args: [\"cat\"]\ntags: [\"$v\"]\n"},
+		{name: "Dockerfile.xxx", content: "FROM alpine:latest"},
+	}))
+	hashTag := calcHash(t, workDir, "Dockerfile.xxx")
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	runner := osrunner.NewReplayer([]osrunner.Record{
+		record("", "docker", "image", "list"),
+		record("", buildArgs(workDir, "Dockerfile.xxx", "xxx:"+hashTag, nil)...),
+		factRecord("1\n", "xxx:"+hashTag, "cat"),
+		record("", "docker", "image", "tag", "xxx:"+hashTag, "xxx:1"),
+		failedRecord("exit status 1", 1, "docker", "image", "tag", "xxx:"+hashTag, "r1/xxx:1"),
+		record("1: digest: "+digest+" size: 528\n", "docker", "image", "push", "r1/xxx:1"),
+	})
+	options := Options{isPush: true, Output: "json"}
+	builder := Builder{Runner: runner, Options: options, Out: io.Discard}
+	report := builder.Build(context.Background(), workDir, "Dockerfile.xxx", nil)
+	assertions.Empty(runner.Unused())
+
+	assertions.Equal(0, report.ExitCode)
+	assertions.Equal("xxx", report.Image)
+	assertions.Equal(hashTag, report.HashTag)
+	assertions.Equal([]InputReport{{Kind: "file", Path: "Dockerfile.xxx", Digest: report.Inputs[0].Digest},
+		{Kind: "sdb", Path: "version", Digest: hash.Version}}, report.Inputs)
+	assertions.Equal("build", report.Build.Decision)
+	assertions.Equal(map[string]string{"v": "1"}, report.Facts)
+	assertions.Equal([]TagsReport{{Mask: "$v", Tags: []string{"1"}, References: []string{"xxx:1", "r1/xxx:1"}}},
+		report.Tags)
+	assertions.Equal([]PushReport{{Reference: "r1/xxx:1", Digest: digest}}, report.Pushes)
+	assertions.Len(report.Warnings, 1)
+	assertions.Len(report.Errors, 1)
+	assertions.Equal("tag", report.Errors[0].Operation)
+	assertions.Equal(1, report.Errors[0].Stages[0].ExitCode)
+}
+
+func TestPlanTags(t *testing.T) {
+	assertions := require.New(t)
+	cfg := Config{Prefixes: []string{"r1", "r2/"}, Tags: []string{"$v", "x"}}
+	operations, err := cfg.PlanTags("a", "h", map[string]string{"v": "1"}, true)
+	assertions.NoError(err)
+	result := make([]string, 0)
+	for _, operation := range operations {
+		result = append(result, operation.Kind+" "+operation.Mask+" "+operation.Tag+": "+strings.Join(operation.Args, " "))
+	}
+	assertions.Equal([]string{
+		"tag $v 1: docker image tag a:h a:1",
+		"tag $v 1: docker image tag a:h r1/a:1",
+		"push $v 1: docker image push r1/a:1",
+		"tag $v 1: docker image tag a:h r2/a:1",
+		"push $v 1: docker image push r2/a:1",
+		"tag x x: docker image tag a:h a:x",
+		"tag x x: docker image tag a:h r1/a:x",
+		"push x x: docker image push r1/a:x",
+		"tag x x: docker image tag a:h r2/a:x",
+		"push x x: docker image push r2/a:x",
+	}, result)
+	operations, err = cfg.PlanTags("a", "h", map[string]string{"v": "1"}, false)
+	assertions.NoError(err)
+	assertions.Len(operations, 6)
+
+	cfg = Config{Tags: []string{`{{ semver .v "major" }}`, "x"}}
+	operations, err = cfg.PlanTags("a", "h", map[string]string{"v": "<v>"}, false)
+	assertions.ErrorContains(err, `"<v>" is not a version`)
+	assertions.Len(operations, 1)
+}
+
+func TestDoRulesFailedMask(t *testing.T) {
+	assertions := require.New(t)
+	cfg := Config{Tags: []string{`{{ semver .v "major" }}`, "x"}}
+	runner := osrunner.NewReplayer([]osrunner.Record{record("", "docker", "image", "tag", "a:h", "a:x")})
+	report := &Report{}
+	r := reporter{out: io.Discard, report: report}
+	exitCode := cfg.DoRules(context.Background(), r, runner, time.Minute, "a", "h", map[string]string{"v": "latest"}, false)
+	assertions.Equal(1, exitCode)
+	assertions.Empty(runner.Unused())
+	assertions.Equal("tags", report.Errors[0].Operation)
+	assertions.Contains(report.Errors[0].Error, `"latest" is not a version`)
+	assertions.Equal("x", report.Tags[0].Mask)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	assertions := require.New(t)
+	fileName := filepath.Join(t.TempDir(), "records.json")
+	options, err := parseOptions([]string{"-record", fileName})
+	assertions.NoError(err)
+	runner, recorder, err := newRunner(options)
+	assertions.NoError(err)
+	value, recordErr := RunCmdChain(context.Background(), runner, 0, false, "a", []string{"b"})
+	assertions.Empty(value)
+	assertions.NoError(recorder.Save(fileName))
+
+	options, err = parseOptions([]string{"-replay", fileName})
+	assertions.NoError(err)
+	runner, recorder, err = newRunner(options)
+	assertions.NoError(err)
+	assertions.Nil(recorder)
+	_, replayErr := RunCmdChain(context.Background(), runner, 0, false, "a", []string{"b"})
+	assertions.Equal(recordErr == nil, replayErr == nil)
+	_, err = RunCmdChain(context.Background(), runner, 0, false, "a", []string{"b"})
+	assertions.Error(err)
+}
+
 func TestParseOptions(t *testing.T) {
 	variants := []struct {
 		args   []string
@@ -78,19 +843,75 @@ func TestParseOptions(t *testing.T) {
 	}{
 		{
 			args:   []string{"-help"},
-			result: Options{isHelp: true},
+			result: Options{Jobs: 1, isHelp: true},
 		},
 		{
 			args:   []string{"-version"},
-			result: Options{isVersion: true},
+			result: Options{Jobs: 1, isVersion: true},
 		},
 		{
 			args:   []string{"-force", "Dockerfile"},
-			result: Options{isForce: true, DockerfileName: "Dockerfile"},
+			result: Options{Jobs: 1, isForce: true, Dockerfiles: []string{"Dockerfile"}},
 		},
 		{
 			args:   []string{"Dockerfile"},
-			result: Options{DockerfileName: "Dockerfile"},
+			result: Options{Jobs: 1, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-timeout", "1m", "-build-timeout", "1h", "Dockerfile"},
+			result: Options{Jobs: 1, Timeout: time.Minute, BuildTimeout: time.Hour, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-record", "a.json", "-replay", "b.json", "Dockerfile"},
+			result: Options{Jobs: 1, RecordFile: "a.json", ReplayFile: "b.json", Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-dry-run", "Dockerfile"},
+			result: Options{Jobs: 1, isDryRun: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-list-facts"},
+			result: Options{Jobs: 1, isListFacts: true},
+		},
+		{
+			args:   []string{"-facts-dir", "a", "-facts-dir", "b", "Dockerfile"},
+			result: Options{Jobs: 1, FactsDirs: []string{"a", "b"}, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"affected", "-since", "main", "-build", "images"},
+			result: Options{Jobs: 1, Command: "affected", Since: "main", isBuild: true, Dockerfiles: []string{"images"}},
+		},
+		{
+			args:   []string{"-no-manifest-label", "Dockerfile"},
+			result: Options{Jobs: 1, isNoLabel: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-no-hash-cache", "Dockerfile"},
+			result: Options{Jobs: 1, isNoHashCache: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"hash", "Dockerfile"},
+			result: Options{Jobs: 1, Command: "hash", Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"plan", "Dockerfile"},
+			result: Options{Jobs: 1, Command: "plan", isDryRun: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"push", "Dockerfile"},
+			result: Options{Jobs: 1, Command: "push", isPush: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"-jobs", "4", "-keep-going", "Dockerfile"},
+			result: Options{Jobs: 4, isKeepGoing: true, Dockerfiles: []string{"Dockerfile"}},
+		},
+		{
+			args:   []string{"a/Dockerfile", "images/**/Dockerfile*"},
+			result: Options{Jobs: 1, Dockerfiles: []string{"a/Dockerfile", "images/**/Dockerfile*"}},
+		},
+		{
+			args:   []string{"-output", "json", "Dockerfile"},
+			result: Options{Jobs: 1, Output: "json", Dockerfiles: []string{"Dockerfile"}},
 		},
 	}
 	for n, variant := range variants {
@@ -103,13 +924,12 @@ func TestParseOptions(t *testing.T) {
 
 func TestCreateDockerTag(t *testing.T) {
 	assertions := require.New(t)
-	assertions.Equal("docker image tag a:b a:c", strings.Join(createDockerTag("a:b", "a:c").Args, " "))
+	assertions.Equal("docker image tag a:b a:c", strings.Join(createDockerTag("a:b", "a:c"), " "))
 }
 
-func TestDockerImageList(t *testing.T) {
+func TestPushDockerImage(t *testing.T) {
 	assertions := require.New(t)
-	cmd, _ := DockerImageList()
-	assertions.Equal("docker image list", strings.Join(cmd.Args, " "))
+	assertions.Equal("docker image push a:b", strings.Join(pushDockerImage("a", "b"), " "))
 }
 
 func TestLoadConfig(t *testing.T) {
@@ -140,6 +960,52 @@ func TestLoadConfig(t *testing.T) {
 			},
 			isError: false,
 		},
+		{
+			content: FileContent{
+				name: "a.sdb.yaml",
+				content: "fact_timeout: 30s\n" +
+					"facts:\n" +
+					"  - name: os-name\n" +
+					"    cmd: os-name\n" +
+					"    timeout: 1m\n",
+			},
+			isError: false,
+		},
+		{
+			content: FileContent{
+				name:    "a.sdb.yaml",
+				content: "fact_timeout: soon\n",
+			},
+			isError: true,
+		},
+		{
+			content: FileContent{
+				name:    "a.sdb.yaml",
+				content: "tags:\n  - '{{ .os-name | lower }}-{{ semver .os-version \"major\" }}'\n",
+			},
+			isError: false,
+		},
+		{
+			content: FileContent{
+				name:    "a.sdb.yaml",
+				content: "tags:\n  - '{{ .os-name | lower'\n",
+			},
+			isError: true,
+		},
+		{
+			content: FileContent{
+				name:    "a.sdb.yaml",
+				content: "missing_sources: warn\n",
+			},
+			isError: false,
+		},
+		{
+			content: FileContent{
+				name:    "a.sdb.yaml",
+				content: "missing_sources: warnn\n",
+			},
+			isError: true,
+		},
 		{
 			content: FileContent{
 				name:    "a.sdb.yaml",
@@ -163,38 +1029,58 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
-func TestCheckOldImage(t *testing.T) {
+func TestFactTimeout(t *testing.T) {
 	variants := []struct {
-		isForce bool
-		isNeed  bool
+		cfg     Config
+		def     Def
+		timeout time.Duration
+		result  time.Duration
 	}{
-		{isForce: true, isNeed: true},
-		{isForce: false, isNeed: true},
+		{cfg: Config{}, def: Def{}, timeout: time.Second, result: time.Second},
+		{cfg: Config{FactTimeout: time.Minute}, def: Def{}, timeout: time.Second, result: time.Minute},
+		{cfg: Config{FactTimeout: time.Minute}, def: Def{Timeout: time.Hour}, timeout: time.Second, result: time.Hour},
 	}
 	assertions := require.New(t)
 	for n, variant := range variants {
-		isNeed, err := checkOldBuild(variant.isForce, "a", "1")
-		assertions.NoError(err, n)
-		assertions.Equal(variant.isNeed, isNeed, n)
+		assertions.Equal(variant.result, variant.cfg.factTimeout(variant.def, variant.timeout), n)
 	}
 }
 
-func TestAssetDir(t *testing.T) {
+func TestExitCode(t *testing.T) {
 	variants := []struct {
-		name string
-		err  bool
+		err    error
+		result int
 	}{
-		{name: "", err: false},
-		{name: "a", err: true},
+		{err: errors.New("a"), result: 1},
+		{err: context.DeadlineExceeded, result: exitTimeout},
+		{err: fmt.Errorf("a: %w", context.Canceled), result: exitInterrupted},
 	}
 	assertions := require.New(t)
 	for n, variant := range variants {
-		_, err := AssetDir(variant.name)
-		assertions.Equal(variant.err, err != nil, n)
+		assertions.Equal(variant.result, exitCode(variant.err), n)
 	}
 }
 
-func TestRestoreAssets(t *testing.T) {
+func TestRunCommandTimeout(t *testing.T) {
+	assertions := require.New(t)
+	_, err := runCommand(context.Background(), osrunner.ExecRunner{}, 50*time.Millisecond, []string{"sleep", "5"})
+	assertions.True(errors.Is(err, context.DeadlineExceeded), err)
+}
+
+func TestCheckOldImage(t *testing.T) {
+	variants := []struct {
+		isForce bool
+		isNeed  bool
+	}{
+		{isForce: true, isNeed: true},
+		{isForce: false, isNeed: true},
+	}
 	assertions := require.New(t)
-	assertions.NoError(RestoreAssets(t.TempDir(), ""))
+	for n, variant := range variants {
+		runner := osrunner.NewReplayer([]osrunner.Record{record("", "docker", "image", "list")})
+		builder := Builder{Runner: runner, Options: Options{isForce: variant.isForce}}
+		isNeed, err := builder.checkOldBuild(context.Background(), reporter{out: io.Discard, report: &Report{}}, "a", "1")
+		assertions.NoError(err, n)
+		assertions.Equal(variant.isNeed, isNeed, n)
+	}
 }
@@ -62,11 +62,6 @@ else
   fi  
 fi
 
-GO_BINDATA=$(which go-bindata) 
-if [ "$GO_BINDATA" = "" ]; then
-    go install github.com/go-bindata/go-bindata/go-bindata@latest
-fi
-
 if [ ! -f build/prj2hash ]; then
     echo "### -[*]-[ install prj2hash ]------------"
     cd build || exit
@@ -100,12 +95,6 @@ cd "$CDIR" || exit
 # echo "### -[*]-[ Mod ]------------"
 # go mod tidy
 
-echo "### -[*]-[ Generate ]--------"
-if ! go generate; then
-    echo "### aborted"
-    exit 1
-fi
-
 cd "${CDIR}" || exit
 echo "### -[*]-[ Lint ]------------"
 if ! ./build/golangci-lint run ./...; then
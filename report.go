@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/abatalev/smartdockerbuild/internal/hash"
+	"github.com/abatalev/smartdockerbuild/internal/osrunner"
+)
+
+var pushDigestPattern = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
+// Summary is the result of a run, -output json prints it to stdout.
+type Summary struct {
+	Images   []Report `json:"images"`
+	Affected []string `json:"affected,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Seconds  float64  `json:"seconds"`
+	ExitCode int      `json:"exit_code"`
+}
+
+// Report is the result of an image build.
+type Report struct {
+	Dockerfile string            `json:"dockerfile"`
+	Image      string            `json:"image,omitempty"`
+	HashTag    string            `json:"hash_tag,omitempty"`
+	Inputs     []InputReport     `json:"inputs,omitempty"`
+	Build      BuildReport       `json:"build"`
+	Facts      map[string]string `json:"facts,omitempty"`
+	Tags       []TagsReport      `json:"tags,omitempty"`
+	Pushes     []PushReport      `json:"pushes,omitempty"`
+	Operations [][]string        `json:"operations,omitempty"`
+	Warnings   []string          `json:"warnings,omitempty"`
+	Errors     []ErrorReport     `json:"errors,omitempty"`
+	ExitCode   int               `json:"exit_code"`
+}
+
+type InputReport struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+}
+
+// BuildReport tells whether the image was built ("build") or already existed ("skip").
+type BuildReport struct {
+	Decision string  `json:"decision,omitempty"`
+	DryRun   bool    `json:"dry_run,omitempty"`
+	Seconds  float64 `json:"seconds"`
+}
+
+type TagsReport struct {
+	Mask       string   `json:"mask"`
+	Tags       []string `json:"tags"`
+	References []string `json:"references"`
+}
+
+type PushReport struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+type ErrorReport struct {
+	Operation string                 `json:"operation"`
+	Error     string                 `json:"error"`
+	Stages    []osrunner.StageResult `json:"stages,omitempty"`
+}
+
+// reporter prints progress of an image build and collects its report.
+type reporter struct {
+	out    io.Writer
+	report *Report
+}
+
+func (r reporter) Println(a ...any) {
+	fmt.Fprintln(r.out, a...)
+}
+
+// Warn prints the message after the arrow and keeps it in the report.
+func (r reporter) Warn(arrow, message string) {
+	r.Println(arrow, message)
+	r.report.Warnings = append(r.report.Warnings, message)
+}
+
+// Fail keeps a failed operation with results of its stages in the report.
+func (r reporter) Fail(operation string, err error) {
+	r.logStages(err)
+	r.report.Errors = append(r.report.Errors, ErrorReport{
+		Operation: operation,
+		Error:     err.Error(),
+		Stages:    osrunner.StageResults(err),
+	})
+}
+
+func (r reporter) logStrings(name, content string) {
+	for n, s := range strings.Split(content, "\n") {
+		if n == 0 {
+			r.Println(" ---> "+name+":", s)
+		} else {
+			r.Println("          ->:", s)
+		}
+	}
+}
+
+// logStages shows what every stage of a failed command did.
+func (r reporter) logStages(err error) {
+	for _, stage := range osrunner.StageResults(err) {
+		r.Println(" ----> stage:", strings.Join(stage.Args, " "))
+		r.Println("          -> exit code:", stage.ExitCode, "duration:", stage.Duration.Round(time.Millisecond))
+		if stage.Stderr != "" {
+			r.logStrings("stderr", stage.Stderr)
+		}
+	}
+}
+
+func (r reporter) addInputs(manifest hash.Manifest) {
+	for _, entry := range manifest.Public() {
+		r.report.Inputs = append(r.report.Inputs, InputReport{Kind: entry.Kind, Path: entry.Name, Digest: entry.Digest})
+	}
+}
+
+func (r reporter) addTags(operations []Operation) {
+	for _, operation := range operations {
+		if operation.Kind != "tag" {
+			continue
+		}
+		tags := r.report.Tags
+		if len(tags) == 0 || tags[len(tags)-1].Mask != operation.Mask {
+			r.report.Tags = append(r.report.Tags, TagsReport{Mask: operation.Mask})
+		}
+		last := &r.report.Tags[len(r.report.Tags)-1]
+		if len(last.Tags) == 0 || last.Tags[len(last.Tags)-1] != operation.Tag {
+			last.Tags = append(last.Tags, operation.Tag)
+		}
+		last.References = append(last.References, operation.Args[len(operation.Args)-1])
+	}
+}
+
+func (r reporter) addPush(operation Operation, stdout []byte) {
+	push := PushReport{Reference: operation.Args[len(operation.Args)-1]}
+	if m := pushDigestPattern.FindSubmatch(stdout); m != nil {
+		push.Digest = string(m[1])
+	}
+	r.report.Pushes = append(r.report.Pushes, push)
+}
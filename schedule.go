@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/abatalev/smartdockerbuild/internal/logic"
+)
+
+type buildResult struct {
+	index  int
+	report Report
+	output *bytes.Buffer
+}
+
+// buildImages builds images (sorted by SortImages) on Options.Jobs workers. An image
+// starts after its upstream images are done. With more than one job the output of an
+// image is buffered and printed at once when the image is done. Without -keep-going
+// the first failure stops starting new images, running builds are finished.
+func (b Builder) buildImages(ctx context.Context, workDir string, images []logic.Image) []Report {
+	jobs := b.Options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	reports := make([]Report, len(images))
+	started := make([]bool, len(images))
+	finished := make(map[string]bool)
+	hashTags := make(map[string]string)
+	results := make(chan buildResult)
+	isStopped := false
+	running, done := 0, 0
+
+	for done < len(images) {
+		for i, image := range images {
+			if started[i] || running >= jobs || !isUpstreamFinished(image, finished) {
+				continue
+			}
+			started[i] = true
+			if b.selected != nil && !b.selected[image.DockerFile] {
+				upstream := make(map[string]string)
+				for _, name := range image.Upstream {
+					upstream[name] = hashTags[name]
+				}
+				cfg, err := imageConfig(workDir, image.DockerFile)
+				hashTag := ""
+				if err == nil {
+					hashTag, _, err = cfg.hashInputs(workDir, image.DockerFile, image.Name, upstream)
+				}
+				if err != nil {
+					fmt.Fprintln(b.out(), " -> "+image.DockerFile+": hash:", err)
+				} else {
+					hashTags[image.Name] = hashTag
+				}
+				finished[image.Name] = true
+				done++
+				continue
+			}
+			if report, ok := b.skipImage(ctx, image, hashTags, isStopped); ok {
+				reports[i] = report
+				finished[image.Name] = true
+				done++
+				continue
+			}
+			upstream := make(map[string]string)
+			for _, name := range image.Upstream {
+				upstream[name] = hashTags[name]
+			}
+			running++
+			go func(i int, dockerFile string) {
+				result := buildResult{index: i}
+				builder := b
+				if jobs > 1 {
+					result.output = &bytes.Buffer{}
+					builder.Out = result.output
+				}
+				result.report = builder.Build(ctx, workDir, dockerFile, upstream)
+				results <- result
+			}(i, image.DockerFile)
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		done++
+		if result.output != nil {
+			_, _ = io.Copy(b.out(), result.output)
+		}
+		image := images[result.index]
+		reports[result.index] = result.report
+		finished[image.Name] = true
+		if result.report.ExitCode == 0 {
+			hashTags[image.Name] = result.report.HashTag
+		} else if !b.Options.isKeepGoing {
+			isStopped = true
+		}
+	}
+	if b.selected != nil {
+		selected := make([]Report, 0, len(b.selected))
+		for i, image := range images {
+			if b.selected[image.DockerFile] {
+				selected = append(selected, reports[i])
+			}
+		}
+		return selected
+	}
+	return reports
+}
+
+func isUpstreamFinished(image logic.Image, finished map[string]bool) bool {
+	for _, name := range image.Upstream {
+		if !finished[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// skipImage returns the report of an image that must not be built: the run is
+// interrupted or stopped after a failure, or an upstream image failed.
+func (b Builder) skipImage(ctx context.Context, image logic.Image, hashTags map[string]string,
+	isStopped bool) (Report, bool) {
+	report := Report{Dockerfile: image.DockerFile, Image: image.Name}
+	r := reporter{out: b.out(), report: &report}
+	if ctx.Err() != nil || isStopped {
+		report.Build.Decision = "aborted"
+		return report, true
+	}
+	if failed := failedUpstream(image, hashTags); failed != "" {
+		report.ExitCode = 1
+		r.Println(" -> file", image.DockerFile)
+		r.Println(" --> skipped! upstream image", failed, "failed")
+		r.report.Errors = append(r.report.Errors, ErrorReport{Operation: "upstream",
+			Error: "upstream image " + failed + " failed"})
+		return report, true
+	}
+	return Report{}, false
+}